@@ -76,6 +76,26 @@ spec:
             - pods
             verbs:
             - get
+          - apiGroups:
+            - ""
+            resources:
+            - configmaps
+            verbs:
+            - get
+            - list
+            - watch
+          - apiGroups:
+            - apps
+            resources:
+            - replicasets
+            verbs:
+            - get
+          - apiGroups:
+            - batch
+            resources:
+            - jobs
+            verbs:
+            - get
           serviceAccountName: telegraf-operator
       deployments:
         - name: telegraf-operator
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+)
+
+// agentSettingKind describes what values an [agent] setting accepts.
+type agentSettingKind int
+
+const (
+	agentSettingString agentSettingKind = iota
+	agentSettingBool
+	agentSettingInteger
+	// agentSettingDuration accepts Go style durations as strings, such as "10s", or numbers of seconds
+	agentSettingDuration
+	// agentSettingSize accepts sizes as strings, such as "10MB", or numbers of bytes
+	agentSettingSize
+)
+
+// agentAnnotationSource describes settings from the agent annotation in errors returned by mergeAgentConf.
+var agentAnnotationSource = fmt.Sprintf("%s annotation", TelegrafAgent)
+
+// agentSettings lists settings of the telegraf [agent] table that can be set for a pod.
+var agentSettings = map[string]agentSettingKind{
+	"interval":                          agentSettingDuration,
+	"round_interval":                    agentSettingBool,
+	"metric_batch_size":                 agentSettingInteger,
+	"metric_buffer_limit":               agentSettingInteger,
+	"collection_jitter":                 agentSettingDuration,
+	"collection_offset":                 agentSettingDuration,
+	"flush_interval":                    agentSettingDuration,
+	"flush_jitter":                      agentSettingDuration,
+	"precision":                         agentSettingDuration,
+	"debug":                             agentSettingBool,
+	"quiet":                             agentSettingBool,
+	"logtarget":                         agentSettingString,
+	"logfile":                           agentSettingString,
+	"logformat":                         agentSettingString,
+	"log_with_timezone":                 agentSettingString,
+	"logfile_rotation_interval":         agentSettingDuration,
+	"logfile_rotation_max_size":         agentSettingSize,
+	"logfile_rotation_max_archives":     agentSettingInteger,
+	"hostname":                          agentSettingString,
+	"omit_hostname":                     agentSettingBool,
+	"always_include_local_tags":         agentSettingBool,
+	"skip_processors_after_aggregators": agentSettingBool,
+	"buffer_strategy":                   agentSettingString,
+	"buffer_directory":                  agentSettingString,
+}
+
+// mergeAgentConf merges [agent] settings into the [agent] table of class data, with the given settings taking
+// precedence; the resulting [agent] table is placed at the end of the class data. The source describes where
+// the settings come from, such as the agent annotation, and is used in errors.
+func mergeAgentConf(classData, agentRaw, source string) (string, error) {
+	agent, err := parseAgentSettings(agentRaw)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", source, err)
+	}
+
+	tbl, err := toml.Parse([]byte(classData))
+	if err != nil {
+		return "", err
+	}
+
+	if value, ok := tbl.Fields["agent"]; ok {
+		classAgent, ok := value.(*ast.Table)
+		if !ok {
+			return "", fmt.Errorf("agent must be a table")
+		}
+		for key, field := range classAgent.Fields {
+			if _, ok := agent[key]; ok {
+				continue
+			}
+			if kv, ok := field.(*ast.KeyValue); ok {
+				agent[key] = kv.Value.Source()
+			}
+		}
+		classData = removeTable(classData, classAgent)
+	}
+
+	keys := make([]string, 0, len(agent))
+	for key := range agent {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	agentConf := "[agent]\n"
+	for _, key := range keys {
+		agentConf = fmt.Sprintf("%s  %s = %s\n", agentConf, tomlKey(key), agent[key])
+	}
+
+	if !strings.HasSuffix(classData, "\n") {
+		classData += "\n"
+	}
+	return fmt.Sprintf("%s%s", classData, agentConf), nil
+}
+
+// parseAgentSettings parses and validates [agent] settings specified as TOML key-value pairs,
+// returning the TOML source of each value.
+func parseAgentSettings(agentRaw string) (map[string]string, error) {
+	tbl, err := toml.Parse([]byte(agentRaw))
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	for key, field := range tbl.Fields {
+		kv, ok := field.(*ast.KeyValue)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a setting, not a table", key)
+		}
+		kind, ok := agentSettings[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown agent setting %s", key)
+		}
+		if err := validateAgentSetting(kind, kv.Value); err != nil {
+			return nil, fmt.Errorf("invalid value for agent setting %s: %v", key, err)
+		}
+		settings[key] = kv.Value.Source()
+	}
+
+	return settings, nil
+}
+
+// validateAgentSetting checks that the value is valid for the kind of setting.
+func validateAgentSetting(kind agentSettingKind, value ast.Value) error {
+	switch v := value.(type) {
+	case *ast.String:
+		switch kind {
+		case agentSettingString, agentSettingSize:
+			return nil
+		case agentSettingDuration:
+			if v.Value == "" {
+				return nil
+			}
+			_, err := time.ParseDuration(v.Value)
+			return err
+		}
+	case *ast.Boolean:
+		if kind == agentSettingBool {
+			return nil
+		}
+	case *ast.Integer:
+		switch kind {
+		case agentSettingInteger, agentSettingDuration, agentSettingSize:
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected value %s", value.Source())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_mergeAgentConf(t *testing.T) {
+	tests := []struct {
+		name      string
+		classData string
+		agentRaw  string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "settings are added to class without agent table",
+			classData: `[[outputs.file]]
+  files = ["stdout"]`,
+			agentRaw: `flush_interval = "30s"
+metric_buffer_limit = 50000`,
+			want: `[[outputs.file]]
+  files = ["stdout"]
+[agent]
+  flush_interval = "30s"
+  metric_buffer_limit = 50000`,
+		},
+		{
+			name: "annotation takes precedence over class",
+			classData: `[agent]
+  interval = "10s"
+  flush_interval = "10s"
+[[outputs.file]]
+  files = ["stdout"]`,
+			agentRaw: `flush_interval = "1m"
+round_interval = false
+logformat = "structured"`,
+			want: `[[outputs.file]]
+  files = ["stdout"]
+[agent]
+  flush_interval = "1m"
+  interval = "10s"
+  logformat = "structured"
+  round_interval = false`,
+		},
+		{
+			name:      "durations may be numbers of seconds",
+			classData: "",
+			agentRaw:  "collection_jitter = 5",
+			want: `[agent]
+  collection_jitter = 5`,
+		},
+		{
+			name:     "unknown setting",
+			agentRaw: `flush_intervals = "30s"`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid duration",
+			agentRaw: `flush_interval = "30 seconds"`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid type",
+			agentRaw: `metric_buffer_limit = "50000"`,
+			wantErr:  true,
+		},
+		{
+			name:     "tables are not allowed",
+			agentRaw: "[agent]\n  interval = \"10s\"",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid TOML",
+			agentRaw: `interval = `,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeAgentConf(tt.classData, tt.agentRaw, agentAnnotationSource)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("mergeAgentConf() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if strings.TrimSpace(got) != strings.TrimSpace(tt.want) {
+				t.Errorf("mergeAgentConf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mergeAgentConf_source(t *testing.T) {
+	_, err := mergeAgentConf("", "unknown = true", bufferAgentSource)
+	if want := "invalid agent settings for the buffer volume: unknown agent setting unknown"; err == nil || err.Error() != want {
+		t.Errorf("mergeAgentConf() error = %v, want %v", err, want)
+	}
+
+	_, err = mergeAgentConf("", "unknown = true", agentAnnotationSource)
+	if want := "invalid telegraf.influxdata.com/agent annotation: unknown agent setting unknown"; err == nil || err.Error() != want {
+		t.Errorf("mergeAgentConf() error = %v, want %v", err, want)
+	}
+}
+
+func Test_assembleConf_agent(t *testing.T) {
+	handler := &sidecarHandler{
+		ClassDataHandler: newMockClassDataHandler(map[string]string{
+			"class": "[agent]\n  interval = \"10s\"\n[[outputs.file]]\n  files = [\"stdout\"]\n",
+		}),
+		Logger: testr.New(t),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				TelegrafAgent: `interval = "30s"`,
+			},
+		},
+	}
+
+	got, err := handler.assembleConf(pod, "class")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[[outputs.file]]\n  files = [\"stdout\"]\n[agent]\n  interval = \"30s\""
+	if strings.TrimSpace(got) != want {
+		t.Errorf("assembleConf() = %v, want %v", got, want)
+	}
+
+	pod.Annotations[TelegrafAgent] = `unknown = true`
+	if _, err := handler.assembleConf(pod, "class"); err == nil {
+		t.Errorf("expected an error for unknown agent setting, but none was reported")
+	}
+}
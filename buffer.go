@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// bufferPath is the directory in which the volume used for buffering metrics on disk is mounted
+	bufferPath = "/var/run/telegraf/buffer"
+
+	// BufferMediumDisk and BufferMediumMemory are the supported media of the buffer volume
+	BufferMediumDisk   = "disk"
+	BufferMediumMemory = "memory"
+)
+
+// bufferSettings describes the volume used for buffering metrics on disk.
+type bufferSettings struct {
+	// SizeLimit is the size limit of the volume, such as 1Gi; buffering on disk is enabled when it is set
+	SizeLimit string `toml:"size_limit"`
+	// Medium is the medium backing the volume, "disk" or "memory"; defaults to disk
+	Medium string `toml:"medium"`
+}
+
+// buffer returns the volume for buffering metrics on disk, based on the pod's annotations and the class settings,
+// which the annotations take precedence over; nil is returned if no size limit is configured.
+func buffer(pod *corev1.Pod, settings *classSettings) (*corev1.EmptyDirVolumeSource, error) {
+	var sizeLimit, medium string
+	if settings.Buffer != nil {
+		sizeLimit = settings.Buffer.SizeLimit
+		medium = settings.Buffer.Medium
+	}
+	if value, ok := pod.Annotations[TelegrafBufferSizeLimit]; ok {
+		sizeLimit = value
+	}
+	if value, ok := pod.Annotations[TelegrafBufferMedium]; ok {
+		medium = value
+	}
+
+	if sizeLimit == "" {
+		return nil, nil
+	}
+
+	quantity, err := resource.ParseQuantity(sizeLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid buffer size limit %s: %v", sizeLimit, err)
+	}
+	if quantity.Sign() <= 0 {
+		return nil, fmt.Errorf("buffer size limit must be positive, %s given", sizeLimit)
+	}
+
+	volume := &corev1.EmptyDirVolumeSource{SizeLimit: &quantity}
+	switch strings.ToLower(medium) {
+	case "", BufferMediumDisk:
+	case BufferMediumMemory:
+		volume.Medium = corev1.StorageMediumMemory
+	default:
+		return nil, fmt.Errorf("invalid buffer medium %s, expected %s or %s", medium, BufferMediumDisk, BufferMediumMemory)
+	}
+
+	return volume, nil
+}
+
+// bufferAgentSource describes [agent] settings enabling the buffer in errors returned by mergeAgentConf.
+const bufferAgentSource = "agent settings for the buffer volume"
+
+// bufferAgentConf returns [agent] settings enabling buffering metrics on disk, in the volume mounted in the sidecar.
+func bufferAgentConf() string {
+	return fmt.Sprintf("buffer_strategy = \"disk\"\nbuffer_directory = %s\n", tomlString(bufferPath))
+}
+
+// addBufferMemory increases the memory limit by the size of a memory-backed buffer volume, as its contents
+// count towards memory used by the sidecar; limits that are not set are left unbounded.
+func addBufferMemory(limits corev1.ResourceList, volume *corev1.EmptyDirVolumeSource) {
+	if volume == nil || volume.Medium != corev1.StorageMediumMemory {
+		return
+	}
+	memory, ok := limits[corev1.ResourceMemory]
+	if !ok {
+		return
+	}
+	memory.Add(*volume.SizeLimit)
+	limits[corev1.ResourceMemory] = memory
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_buffer(t *testing.T) {
+	gigabyte := resource.MustParse("1Gi")
+	megabytes := resource.MustParse("64Mi")
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		settings    *classSettings
+		want        *corev1.EmptyDirVolumeSource
+		wantErr     bool
+	}{
+		{
+			name:     "disabled by default",
+			settings: &classSettings{},
+		},
+		{
+			name:     "class settings on disk",
+			settings: &classSettings{Buffer: &bufferSettings{SizeLimit: "1Gi"}},
+			want:     &corev1.EmptyDirVolumeSource{SizeLimit: &gigabyte},
+		},
+		{
+			name: "annotations take precedence over class settings",
+			annotations: map[string]string{
+				TelegrafBufferSizeLimit: "64Mi",
+				TelegrafBufferMedium:    "Memory",
+			},
+			settings: &classSettings{Buffer: &bufferSettings{SizeLimit: "1Gi", Medium: "disk"}},
+			want:     &corev1.EmptyDirVolumeSource{SizeLimit: &megabytes, Medium: corev1.StorageMediumMemory},
+		},
+		{
+			name:        "annotation disables class buffer",
+			annotations: map[string]string{TelegrafBufferSizeLimit: ""},
+			settings:    &classSettings{Buffer: &bufferSettings{SizeLimit: "1Gi"}},
+		},
+		{
+			name:        "invalid size limit",
+			annotations: map[string]string{TelegrafBufferSizeLimit: "1 GB"},
+			settings:    &classSettings{},
+			wantErr:     true,
+		},
+		{
+			name:        "negative size limit",
+			annotations: map[string]string{TelegrafBufferSizeLimit: "-1Gi"},
+			settings:    &classSettings{},
+			wantErr:     true,
+		},
+		{
+			name:     "invalid medium",
+			settings: &classSettings{Buffer: &bufferSettings{SizeLimit: "1Gi", Medium: "ssd"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			got, err := buffer(pod, tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("buffer() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buffer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
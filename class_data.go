@@ -19,15 +19,18 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"filippo.io/age"
 	"github.com/go-logr/logr"
-	"github.com/influxdata/toml"
 )
 
 // directoryClassDataHandler provides a handler for getting class data from class name.
 type directoryClassDataHandler struct {
 	Logger                   logr.Logger
 	TelegrafClassesDirectory string
+	// Identities are age identities used for decrypting encrypted class data
+	Identities []age.Identity
 }
 
 // classDataHandler defines interface for validating class data and converting from class name to class data.
@@ -67,7 +70,11 @@ func (c *directoryClassDataHandler) validateClassData() error {
 				c.Logger.Info(fmt.Sprintf("unable to retrieve class data from file %s: %v", file.Name(), err))
 			} else {
 				filesAvailable = true
-				if _, err := toml.Parse(data); err != nil {
+				decrypted, err := decryptClassData(string(data), c.Identities)
+				if err != nil {
+					c.Logger.Info(fmt.Sprintf("unable to decrypt class data %s: %v", file.Name(), err))
+					classDataValid = false
+				} else if err := validateClassData(file.Name(), decrypted); err != nil {
 					c.Logger.Info(fmt.Sprintf("unable to parse class data %s: %v", file.Name(), err))
 					classDataValid = false
 				}
@@ -88,12 +95,41 @@ func (c *directoryClassDataHandler) validateClassData() error {
 
 // getData returns class data for a given class name.
 func (c *directoryClassDataHandler) getData(className string) (string, error) {
-	data, err := ioutil.ReadFile(filepath.Join(c.TelegrafClassesDirectory, className))
+	data, err := c.readClassData(className)
 
 	if err != nil {
 		c.Logger.Info("unable to class data for %s: %v", className, err)
 		return "", err
 	}
 
-	return string(data), nil
+	return data, nil
+}
+
+// readClassData reads class data from a file, decrypting it if needed.
+func (c *directoryClassDataHandler) readClassData(className string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.TelegrafClassesDirectory, className))
+	if err != nil {
+		return "", err
+	}
+
+	decrypted, err := decryptClassData(string(data), c.Identities)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt class %s: %v", className, err)
+	}
+
+	return decrypted, nil
+}
+
+// validateClassData checks that the class data is valid; templates are rendered for a sample pod first.
+func validateClassData(className, data string) error {
+	if strings.HasSuffix(className, classTemplateSuffix) {
+		var err error
+		data, err = renderClassTemplate(className, data, sampleClassTemplateContext)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _, err := parseClassData(data)
+	return err
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ageArmorRegexp matches age-encrypted, armored blocks, which may be used for whole class files or values inside them.
+var ageArmorRegexp = regexp.MustCompile(`(?s)` + regexp.QuoteMeta(armor.Header) + `.*?` + regexp.QuoteMeta(armor.Footer))
+
+// sopsValueRegexp matches values encrypted by SOPS, capturing the data, IV, tag and type.
+var sopsValueRegexp = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:([a-z]+)\]$`)
+
+// sopsFile describes a file encrypted by SOPS in binary format, which is used for files such as classes
+// that are not JSON, YAML, INI or dotenv files.
+type sopsFile struct {
+	Data string `json:"data"`
+	Sops *struct {
+		Age []struct {
+			Recipient string `json:"recipient"`
+			Enc       string `json:"enc"`
+		} `json:"age"`
+		LastModified string `json:"lastmodified"`
+		MAC          string `json:"mac"`
+	} `json:"sops"`
+}
+
+// loadAgeIdentities reads age identities used for decrypting class data from a file.
+func loadAgeIdentities(filename string) ([]age.Identity, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse age identities from %s: %v", filename, err)
+	}
+
+	return identities, nil
+}
+
+// decryptClassData decrypts class data encrypted using SOPS, as well as age-encrypted class data or values in it;
+// class data that is not encrypted is returned as is.
+func decryptClassData(data string, identities []age.Identity) (string, error) {
+	if sops, ok := parseSopsFile(data); ok {
+		if len(identities) == 0 {
+			return "", fmt.Errorf("class data is encrypted using SOPS, but no age key was provided")
+		}
+		return sops.decrypt(identities)
+	}
+
+	var err error
+	data = ageArmorRegexp.ReplaceAllStringFunc(data, func(armored string) string {
+		if err != nil {
+			return ""
+		}
+		if len(identities) == 0 {
+			err = fmt.Errorf("class data is encrypted using age, but no age key was provided")
+			return ""
+		}
+
+		var plaintext []byte
+		plaintext, err = ageDecrypt(armored, identities)
+		return string(plaintext)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return data, nil
+}
+
+// ageDecrypt decrypts an armored age-encrypted block.
+func ageDecrypt(armored string, identities []age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(armored)), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt age-encrypted data: %v", err)
+	}
+
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt age-encrypted data: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+// parseSopsFile checks whether data is a file encrypted by SOPS in binary format and parses it.
+func parseSopsFile(data string) (*sopsFile, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(data), "{") {
+		return nil, false
+	}
+
+	sops := &sopsFile{}
+	if err := json.Unmarshal([]byte(data), sops); err != nil || sops.Sops == nil {
+		return nil, false
+	}
+
+	return sops, true
+}
+
+// decrypt decrypts the data key using one of the age identities and then the data using the data key,
+// verifying the message authentication code of the file, so that its contents can not be replaced.
+func (s *sopsFile) decrypt(identities []age.Identity) (string, error) {
+	var dataKey []byte
+	for _, key := range s.Sops.Age {
+		if plaintext, err := ageDecrypt(key.Enc, identities); err == nil {
+			dataKey = plaintext
+			break
+		}
+	}
+	if dataKey == nil {
+		return "", fmt.Errorf("unable to decrypt SOPS data key using any of the provided age keys")
+	}
+
+	// SOPS uses the path of the value as additional data, which is "data:" for files in binary format
+	plaintext, err := sopsDecryptValue(s.Data, dataKey, "data:")
+	if err != nil {
+		return "", err
+	}
+
+	// the MAC is a SHA-512 hash of all values, which is only the data for files in binary format,
+	// encrypted using the time the file was last modified as additional data
+	lastModified, err := time.Parse(time.RFC3339, s.Sops.LastModified)
+	if err != nil {
+		return "", fmt.Errorf("invalid SOPS lastmodified %q: %v", s.Sops.LastModified, err)
+	}
+	mac, err := sopsDecryptValue(s.Sops.MAC, dataKey, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt SOPS MAC: %v", err)
+	}
+	if subtle.ConstantTimeCompare(mac, []byte(fmt.Sprintf("%X", sha512.Sum512(plaintext)))) != 1 {
+		return "", fmt.Errorf("SOPS MAC does not match the encrypted data")
+	}
+
+	return string(plaintext), nil
+}
+
+// sopsDecryptValue decrypts a single value encrypted by SOPS using the data key.
+func sopsDecryptValue(value string, dataKey []byte, additionalData string) ([]byte, error) {
+	match := sopsValueRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return nil, fmt.Errorf("invalid SOPS encrypted data")
+	}
+
+	var decoded [3][]byte
+	for i := range decoded {
+		value, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOPS encrypted data: %v", err)
+		}
+		decoded[i] = value
+	}
+	ciphertext, iv, tag := decoded[0], decoded[1], decoded[2]
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOPS data key: %v", err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOPS encrypted data: %v", err)
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt SOPS encrypted data: %v", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/go-logr/logr/testr"
+)
+
+// ageEncrypt encrypts plaintext for the recipient, returning an armored block.
+func ageEncrypt(t *testing.T, recipient age.Recipient, plaintext []byte) string {
+	var buf bytes.Buffer
+	a := armor.NewWriter(&buf)
+	w, err := age.Encrypt(a, recipient)
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	return buf.String()
+}
+
+// sopsEncrypt encrypts plaintext the same way SOPS encrypts files in binary format.
+func sopsEncrypt(t *testing.T, recipient *age.X25519Recipient, plaintext string) string {
+	return sopsEncryptWithMAC(t, recipient, plaintext, plaintext)
+}
+
+// sopsEncryptWithMAC encrypts plaintext the same way SOPS encrypts files in binary format, using the MAC of macPlaintext.
+func sopsEncryptWithMAC(t *testing.T, recipient *age.X25519Recipient, plaintext, macPlaintext string) string {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+
+	lastModified := "2021-01-01T00:00:00Z"
+	data, err := json.Marshal(map[string]interface{}{
+		"data": sopsEncryptValue(t, dataKey, plaintext, "data:"),
+		"sops": map[string]interface{}{
+			"age": []map[string]string{{
+				"recipient": recipient.String(),
+				"enc":       ageEncrypt(t, recipient, dataKey),
+			}},
+			"lastmodified": lastModified,
+			"mac":          sopsEncryptValue(t, dataKey, fmt.Sprintf("%X", sha512.Sum512([]byte(macPlaintext))), lastModified),
+			"version":      "3.7.1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// sopsEncryptValue encrypts a single value the same way SOPS does.
+func sopsEncryptValue(t *testing.T, dataKey []byte, plaintext, additionalData string) string {
+	iv := make([]byte, 32)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := gcm.Seal(nil, iv, []byte(plaintext), []byte(additionalData))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]",
+		base64.StdEncoding.EncodeToString(ciphertext),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag))
+}
+
+func Test_decryptClassData(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		data       string
+		identities []age.Identity
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "plain class data is returned as is",
+			data:       sampleClassData,
+			identities: []age.Identity{identity},
+			want:       sampleClassData,
+		},
+		{
+			name: "plain class data does not need keys",
+			data: sampleClassData,
+			want: sampleClassData,
+		},
+		{
+			name:       "SOPS encrypted class data",
+			data:       sopsEncrypt(t, identity.Recipient(), sampleClassData),
+			identities: []age.Identity{otherIdentity, identity},
+			want:       sampleClassData,
+		},
+		{
+			name:       "SOPS encrypted class data with wrong key",
+			data:       sopsEncrypt(t, identity.Recipient(), sampleClassData),
+			identities: []age.Identity{otherIdentity},
+			wantErr:    true,
+		},
+		{
+			name:       "SOPS encrypted class data with mismatched MAC",
+			data:       sopsEncryptWithMAC(t, identity.Recipient(), sampleClassData, "[[outputs.file]]\n"),
+			identities: []age.Identity{identity},
+			wantErr:    true,
+		},
+		{
+			name:       "SOPS encrypted class data without MAC",
+			data:       strings.Replace(sopsEncrypt(t, identity.Recipient(), sampleClassData), `"mac":`, `"unused":`, 1),
+			identities: []age.Identity{identity},
+			wantErr:    true,
+		},
+		{
+			name:    "SOPS encrypted class data without keys",
+			data:    sopsEncrypt(t, identity.Recipient(), sampleClassData),
+			wantErr: true,
+		},
+		{
+			name:       "age encrypted class data",
+			data:       strings.TrimSpace(ageEncrypt(t, identity.Recipient(), []byte(sampleClassData))),
+			identities: []age.Identity{identity},
+			want:       sampleClassData,
+		},
+		{
+			name:       "age encrypted values",
+			data:       "[[outputs.influxdb_v2]]\n  token = '''" + strings.TrimSpace(ageEncrypt(t, identity.Recipient(), []byte("secret"))) + "'''\n",
+			identities: []age.Identity{identity},
+			want:       "[[outputs.influxdb_v2]]\n  token = '''secret'''\n",
+		},
+		{
+			name:       "age encrypted values with wrong key",
+			data:       "[[outputs.influxdb_v2]]\n  token = '''" + strings.TrimSpace(ageEncrypt(t, identity.Recipient(), []byte("secret"))) + "'''\n",
+			identities: []age.Identity{otherIdentity},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptClassData(tt.data, tt.identities)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decryptClassData() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("decryptClassData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_directoryClassDataHandler_encrypted(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := createTempClassesDirectory(t, map[string]string{
+		"encrypted": sopsEncrypt(t, identity.Recipient(), sampleClassData),
+	})
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(t.TempDir(), "age-key.txt")
+	if err := os.WriteFile(keyFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &directoryClassDataHandler{
+		Logger:                   testr.New(t),
+		TelegrafClassesDirectory: dir,
+	}
+	if err := handler.validateClassData(); err == nil {
+		t.Errorf("expected validation error without age keys, but none was reported")
+	}
+
+	handler.Identities, err = loadAgeIdentities(keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := handler.validateClassData(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	got, err := handler.getData("encrypted")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.TrimSpace(got) != strings.TrimSpace(sampleClassData) {
+		t.Errorf("getData() = %v, want %v", got, sampleClassData)
+	}
+}
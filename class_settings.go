@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+)
+
+// classSettingsTable is the name of the TOML table in class data that holds telegraf-operator specific
+// settings of the class, such as "[telegraf_operator]"; the table and all of its sub-tables are removed
+// from the class data before it is added to telegraf configuration.
+const classSettingsTable = "telegraf_operator"
+
+// classSettings describes telegraf-operator specific settings of a class.
+type classSettings struct {
+	// MetadataTags enables or disables adding Kubernetes metadata as global tags, overriding the operator default
+	MetadataTags *bool `toml:"metadata_tags"`
+	// MetadataTagsLabels lists pod labels to add as global tags, in addition to the ones configured for the operator
+	MetadataTagsLabels []string `toml:"metadata_tags_labels"`
+	// SecretStores maps IDs of secret stores referenced in class data to names of secrets backing them
+	SecretStores map[string]string `toml:"secretstores"`
+	// ServiceAccountToken configures a projected service account token for the sidecar
+	ServiceAccountToken *serviceAccountTokenSettings `toml:"service_account_token"`
+	// ClientCertificate enables issuing client certificates identifying the pod or the workload, "pod" or "workload"
+	ClientCertificate string `toml:"client_certificate"`
+	// Buffer configures a volume for buffering metrics on disk
+	Buffer *bufferSettings `toml:"buffer"`
+	// PrometheusClient enables exposing metrics for prometheus to scrape, instead of or in addition to other outputs
+	PrometheusClient *prometheusClientSettings `toml:"prometheus_client"`
+	// Container configures the telegraf sidecar container
+	Container *containerSettings `toml:"container"`
+}
+
+// serviceAccountTokenSettings describes the projected service account token of a class.
+type serviceAccountTokenSettings struct {
+	// Audience is the intended audience of the token
+	Audience string `toml:"audience"`
+	// Expiration is the requested lifetime of the token, as Go style duration
+	Expiration string `toml:"expiration"`
+}
+
+// parseClassData splits class data into telegraf-operator settings of the class and telegraf configuration.
+func parseClassData(data string) (*classSettings, string, error) {
+	settings := &classSettings{}
+
+	tbl, err := toml.Parse([]byte(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	value, ok := tbl.Fields[classSettingsTable]
+	if !ok {
+		return settings, data, nil
+	}
+
+	settingsTable, ok := value.(*ast.Table)
+	if !ok {
+		return nil, "", fmt.Errorf("%s must be a table", classSettingsTable)
+	}
+
+	if err := toml.UnmarshalTable(settingsTable, settings); err != nil {
+		return nil, "", fmt.Errorf("invalid %s settings: %v", classSettingsTable, err)
+	}
+	if settings.Container != nil {
+		if err := settings.Container.validate(); err != nil {
+			return nil, "", fmt.Errorf("invalid %s container settings: %v", classSettingsTable, err)
+		}
+	}
+
+	return settings, removeTable(data, settingsTable), nil
+}
+
+// removeTable removes text of the table and all of its sub-tables from data that the table was parsed from.
+func removeTable(data string, tbl *ast.Table) string {
+	// remove starting from the end so that positions remain valid; positions are offsets in runes of the data
+	positions := tablePositions(tbl)
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Begin > positions[j].Begin })
+
+	runes := []rune(data)
+	for _, position := range positions {
+		runes = append(runes[:position.Begin], runes[position.End:]...)
+	}
+
+	return string(runes)
+}
+
+// tablePositions returns positions of the table and all of its sub-tables.
+func tablePositions(tbl *ast.Table) []ast.Position {
+	positions := []ast.Position{tbl.Position}
+	for _, value := range tbl.Fields {
+		switch v := value.(type) {
+		case *ast.Table:
+			positions = append(positions, tablePositions(v)...)
+		case []*ast.Table:
+			for _, t := range v {
+				positions = append(positions, tablePositions(t)...)
+			}
+		}
+	}
+	return positions
+}
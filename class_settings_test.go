@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseClassData(t *testing.T) {
+	enabled := true
+
+	tests := []struct {
+		name         string
+		data         string
+		wantSettings *classSettings
+		wantData     string
+		wantErr      bool
+	}{
+		{
+			name:         "class without settings is returned as is",
+			data:         sampleClassData,
+			wantSettings: &classSettings{},
+			wantData:     sampleClassData,
+		},
+		{
+			name: "settings are parsed and removed",
+			data: `
+[[outputs.file]]
+  files = ["stdout"]
+
+[telegraf_operator]
+  metadata_tags = true
+  metadata_tags_labels = ["app", "team"]
+
+[global_tags]
+  type = "app"
+`,
+			wantSettings: &classSettings{
+				MetadataTags:       &enabled,
+				MetadataTagsLabels: []string{"app", "team"},
+			},
+			wantData: `
+[[outputs.file]]
+  files = ["stdout"]
+
+
+
+[global_tags]
+  type = "app"
+`,
+		},
+		{
+			name: "secret stores",
+			data: `
+[telegraf_operator.secretstores]
+  influxdb = "influxdb-auth"
+`,
+			wantSettings: &classSettings{
+				SecretStores: map[string]string{"influxdb": "influxdb-auth"},
+			},
+			wantData: "",
+		},
+		{
+			name:    "unknown settings are rejected",
+			data:    "[telegraf_operator]\n  unknown = true\n",
+			wantErr: true,
+		},
+		{
+			name:    "settings must be a table",
+			data:    "telegraf_operator = true\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid TOML",
+			data:    "[telegraf_operator\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, data, err := parseClassData(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseClassData() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(settings, tt.wantSettings) {
+				t.Errorf("parseClassData() settings = %+v, want %+v", settings, tt.wantSettings)
+			}
+			if strings.TrimSpace(data) != strings.TrimSpace(tt.wantData) {
+				t.Errorf("parseClassData() data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// classTemplateSuffix is the suffix of class names whose data is a Go template, rendered for each pod;
+// pods reference such classes using the class name without the suffix.
+const classTemplateSuffix = ".tmpl"
+
+// classTemplateContext is the data available to class templates.
+type classTemplateContext struct {
+	// Namespace is the namespace of the pod
+	Namespace string
+	// Name is the name of the pod
+	Name string
+	// Labels are the labels of the pod
+	Labels map[string]string
+	// Annotations are the annotations of the pod
+	Annotations map[string]string
+	// WorkloadKind is the kind of the workload that owns the pod, such as Deployment
+	WorkloadKind string
+	// WorkloadName is the name of the workload that owns the pod
+	WorkloadName string
+	// Node is the name of the node the pod runs on, or a reference to the NODENAME environment variable
+	// if the pod is not scheduled yet
+	Node string
+}
+
+// sampleClassTemplateContext is used for rendering class templates when validating class data.
+var sampleClassTemplateContext = &classTemplateContext{
+	Namespace:    "default",
+	Name:         "pod",
+	Labels:       map[string]string{},
+	Annotations:  map[string]string{},
+	WorkloadKind: "Deployment",
+	WorkloadName: "workload",
+	Node:         "${NODENAME}",
+}
+
+// classTemplateFuncs are functions available to class templates, to safely put values in TOML.
+var classTemplateFuncs = template.FuncMap{
+	"toml":    tomlString,
+	"tomlKey": tomlKey,
+	"default": defaultValue,
+}
+
+// newClassTemplateContext returns the data available to class templates when rendering for the pod.
+func (h *sidecarHandler) newClassTemplateContext(pod *corev1.Pod) *classTemplateContext {
+	context := &classTemplateContext{
+		Namespace:   pod.Namespace,
+		Name:        pod.Name,
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+		Node:        pod.Spec.NodeName,
+	}
+	if context.Node == "" {
+		context.Node = "${NODENAME}"
+	}
+	context.WorkloadKind, context.WorkloadName = h.podWorkload(pod)
+
+	return context
+}
+
+// renderClassTemplate renders class data that is a Go template. Labels and annotations that the pod does not
+// have are rendered as empty strings.
+func renderClassTemplate(className, data string, context *classTemplateContext) (string, error) {
+	tmpl, err := template.New(className).Funcs(classTemplateFuncs).Option("missingkey=zero").Parse(data)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, context); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// defaultValue returns the value, or the default if the value is empty, such as for labels the pod does not have.
+func defaultValue(def, value string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// tomlString returns the value as a quoted TOML basic string.
+func tomlString(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			b.WriteString(fmt.Sprintf(`\u%04X`, r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/influxdata/toml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_tomlString(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "mynamespace", want: `"mynamespace"`},
+		{value: `say "hi"`, want: `"say \"hi\""`},
+		{value: `C:\path`, want: `"C:\\path"`},
+		{value: "line\nbreak\x01", want: `"line\nbreak\u0001"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := tomlString(tt.value)
+			if got != tt.want {
+				t.Errorf("tomlString() = %v, want %v", got, tt.want)
+			}
+			if _, err := toml.Parse([]byte("value = " + got)); err != nil {
+				t.Errorf("tomlString() returned invalid TOML: %v", err)
+			}
+		})
+	}
+}
+
+func Test_getClassData_template(t *testing.T) {
+	tests := []struct {
+		name      string
+		classes   map[string]string
+		className string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "class that is not a template is returned as is",
+			classes:   map[string]string{"app": `bucket = "{{ .Namespace }}"`},
+			className: "app",
+			want:      `bucket = "{{ .Namespace }}"`,
+		},
+		{
+			name: "template is rendered for the pod",
+			classes: map[string]string{"app.tmpl": `[[outputs.influxdb_v2]]
+  bucket = "{{ .Namespace }}"
+  organization = {{ index .Labels "team" | toml }}
+  [outputs.influxdb_v2.tags]
+    node = "{{ .Node }}"
+    {{ tomlKey "app.kubernetes.io/name" }} = {{ index .Annotations "description" | toml }}
+{{- if eq .WorkloadKind "StatefulSet" }}
+    workload = "{{ .WorkloadName }}"
+{{- end }}`},
+			className: "app",
+			want: `[[outputs.influxdb_v2]]
+  bucket = "mynamespace"
+  organization = "team \"a\""
+  [outputs.influxdb_v2.tags]
+    node = "${NODENAME}"
+    "app.kubernetes.io/name" = "my\nservice"
+    workload = "db"`,
+		},
+		{
+			name:      "template is rendered when referenced with suffix",
+			classes:   map[string]string{"app.tmpl": `bucket = "{{ .Name }}"`},
+			className: "app.tmpl",
+			want:      `bucket = "myname"`,
+		},
+		{
+			name: "missing labels and annotations are empty",
+			classes: map[string]string{"app.tmpl": `organization = {{ .Labels.owner | toml }}
+bucket = "{{ index .Annotations "bucket" }}"
+environment = {{ .Labels.environment | default "production" | toml }}`},
+			className: "app",
+			want: `organization = ""
+bucket = ""
+environment = "production"`,
+		},
+		{
+			name:      "invalid template",
+			classes:   map[string]string{"app.tmpl": `bucket = "{{ .Namespace"`},
+			className: "app",
+			wantErr:   true,
+		},
+		{
+			name:      "unknown field",
+			classes:   map[string]string{"app.tmpl": `bucket = "{{ .Secret }}"`},
+			className: "app",
+			wantErr:   true,
+		},
+		{
+			name:      "unknown class",
+			classes:   map[string]string{"app.tmpl": `bucket = "{{ .Namespace }}"`},
+			className: "other",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				ClassDataHandler: newMockClassDataHandler(tt.classes),
+				Logger:           testr.New(t),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "myname",
+					Namespace:       "mynamespace",
+					Labels:          map[string]string{"team": `team "a"`},
+					Annotations:     map[string]string{"description": "my\nservice"},
+					OwnerReferences: controllerRef("StatefulSet", "db"),
+				},
+			}
+
+			got, err := handler.getClassData(pod, tt.className)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getClassData() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if strings.TrimSpace(got) != strings.TrimSpace(tt.want) {
+				t.Errorf("getClassData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateClassData_template(t *testing.T) {
+	if err := validateClassData("app.tmpl", `bucket = {{ .Namespace | toml }}`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateClassData("app.tmpl", `organization = {{ .Labels.team | toml }}`); err != nil {
+		t.Errorf("unexpected error for template using a label: %v", err)
+	}
+	if err := validateClassData("app.tmpl", `bucket = {{ .Namespace }}`); err == nil {
+		t.Errorf("expected an error for template rendering invalid TOML, but none was reported")
+	}
+	if err := validateClassData("app", `bucket = {{ .Namespace | toml }}`); err == nil {
+		t.Errorf("expected an error for class that is not a template, but none was reported")
+	}
+}
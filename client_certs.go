@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ClientCertificateScopePod issues client certificates identifying the pod
+	ClientCertificateScopePod = "pod"
+	// ClientCertificateScopeWorkload issues client certificates identifying the workload that owns the pod
+	ClientCertificateScopeWorkload = "workload"
+
+	// TelegrafSecretCertKey, TelegrafSecretKeyKey and TelegrafSecretCAKey are keys of the client certificate,
+	// its private key and the CA certificate in secrets created by telegraf-operator; as the secret is mounted
+	// in /etc/telegraf, they are available as /etc/telegraf/tls.crt, /etc/telegraf/tls.key and /etc/telegraf/ca.crt
+	TelegrafSecretCertKey = "tls.crt"
+	TelegrafSecretKeyKey  = "tls.key"
+	TelegrafSecretCAKey   = "ca.crt"
+
+	// clientCertificateSerialComment is a comment added to telegraf configuration when the client certificate
+	// is rotated, so that telegraf running with --watch-config reloads the configuration and the certificate
+	clientCertificateSerialComment = "# telegraf-operator client certificate serial: "
+	// clientCertificateWatchConfig is the watch config mode used for sidecars with client certificates if none is
+	// configured, as renewed certificates are only used after telegraf reloads its configuration
+	clientCertificateWatchConfig = "inotify"
+
+	defaultClientCertificateValidity = 24 * time.Hour
+	// clientCertificateBackdate allows for clock skew between the operator and servers verifying the certificate
+	clientCertificateBackdate = 5 * time.Minute
+)
+
+var clientCertificateSerialCommentRegexp = regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(clientCertificateSerialComment) + `.*\n?`)
+
+// clientCertIssuer issues short-lived client certificates for telegraf sidecars, signed using a CA stored in a secret.
+type clientCertIssuer struct {
+	Client   client.Reader
+	CASecret types.NamespacedName
+	Validity time.Duration
+}
+
+// clientCertificateSubject returns the subject of the client certificate for the pod, identifying its namespace
+// and the workload that owns it; nil is returned if client certificates are not enabled for the class.
+func (h *sidecarHandler) clientCertificateSubject(pod *corev1.Pod, settings *classSettings) (*pkix.Name, error) {
+	if settings.ClientCertificate == "" {
+		return nil, nil
+	}
+	if h.ClientCertIssuer == nil {
+		return nil, fmt.Errorf("client certificates require a CA to be configured using the --telegraf-client-ca-secret option")
+	}
+
+	kind, name := h.podWorkload(pod)
+	subject := &pkix.Name{
+		Organization: []string{pod.Namespace},
+		CommonName:   pod.Name,
+	}
+	if kind != "" {
+		subject.OrganizationalUnit = []string{kind}
+	}
+
+	switch settings.ClientCertificate {
+	case ClientCertificateScopePod:
+	case ClientCertificateScopeWorkload:
+		if name != "" {
+			subject.CommonName = name
+		}
+	default:
+		return nil, fmt.Errorf("invalid client certificate scope %s, expected %s or %s",
+			settings.ClientCertificate, ClientCertificateScopePod, ClientCertificateScopeWorkload)
+	}
+
+	return subject, nil
+}
+
+// issue creates a new private key and a client certificate for the subject, returning them along with
+// the CA certificate as secret data.
+func (i *clientCertIssuer) issue(ctx context.Context, subject pkix.Name) (map[string][]byte, error) {
+	caSecret := &corev1.Secret{}
+	if err := i.Client.Get(ctx, i.CASecret, caSecret); err != nil {
+		return nil, fmt.Errorf("unable to get CA secret %s: %v", i.CASecret, err)
+	}
+	caPair, err := tls.X509KeyPair(caSecret.Data[corev1.TLSCertKey], caSecret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA secret %s: %v", i.CASecret, err)
+	}
+	caCert, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA secret %s: %v", i.CASecret, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	validity := i.Validity
+	if validity == 0 {
+		validity = defaultClientCertificateValidity
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now.Add(-clientCertificateBackdate),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caPair.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign client certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		TelegrafSecretCertKey: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		TelegrafSecretKeyKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		TelegrafSecretCAKey:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}),
+	}, nil
+}
+
+// clientCertRotator periodically renews client certificates in secrets managed by telegraf-operator
+// before they expire.
+type clientCertRotator struct {
+	logger    logr.Logger
+	clientset kubernetes.Interface
+	issuer    *clientCertIssuer
+	interval  time.Duration
+}
+
+// newClientCertRotator creates new instance of clientCertRotator.
+func newClientCertRotator(logger logr.Logger, clientset kubernetes.Interface, issuer *clientCertIssuer) *clientCertRotator {
+	validity := issuer.Validity
+	if validity == 0 {
+		validity = defaultClientCertificateValidity
+	}
+
+	return &clientCertRotator{
+		logger:    logger,
+		clientset: clientset,
+		issuer:    issuer,
+		interval:  validity / 10,
+	}
+}
+
+// Start runs the rotator until the context is done; it implements manager.Runnable.
+func (r *clientCertRotator) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.rotate(ctx, time.Now()); err != nil {
+			r.logger.Error(err, "unable to rotate client certificates")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// rotate renews client certificates in all namespaces that have less than a third of their lifetime left;
+// errors renewing a single certificate are logged, so that the remaining certificates are still renewed.
+func (r *clientCertRotator) rotate(ctx context.Context, now time.Time) error {
+	secrets, err := r.clientset.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: TelegrafSecretLabelClassName,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets.Items {
+		certPEM, ok := secret.Data[TelegrafSecretCertKey]
+		if !ok {
+			continue
+		}
+
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			r.logger.Info("unable to decode client certificate", "namespace", secret.Namespace, "name", secret.Name)
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			r.logger.Info(fmt.Sprintf("unable to parse client certificate: %v", err), "namespace", secret.Namespace, "name", secret.Name)
+			continue
+		}
+
+		if cert.NotAfter.Sub(now) > cert.NotAfter.Sub(cert.NotBefore)/3 {
+			continue
+		}
+
+		data, err := r.issuer.issue(ctx, cert.Subject)
+		if err != nil {
+			r.logger.Error(err, "unable to issue client certificate", "namespace", secret.Namespace, "name", secret.Name)
+			continue
+		}
+
+		r.logger.Info("rotating client certificate", "namespace", secret.Namespace, "name", secret.Name)
+		updated := secret.DeepCopy()
+		for key, value := range data {
+			updated.Data[key] = value
+		}
+		updated.Data[TelegrafSecretDataKey] = []byte(withClientCertificateSerial(string(secret.Data[TelegrafSecretDataKey]), data[TelegrafSecretCertKey]))
+
+		if _, err := r.clientset.CoreV1().Secrets(secret.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			r.logger.Error(err, "unable to update client certificate", "namespace", secret.Namespace, "name", secret.Name)
+		}
+	}
+
+	return nil
+}
+
+// withClientCertificateSerial replaces the comment with serial number of the client certificate in telegraf configuration.
+func withClientCertificateSerial(telegrafConf string, certPEM []byte) string {
+	telegrafConf = clientCertificateSerialCommentRegexp.ReplaceAllString(telegrafConf, "")
+
+	serial := ""
+	if block, _ := pem.Decode(certPEM); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			serial = fmt.Sprintf("%X", cert.SerialNumber)
+		}
+	}
+
+	if !strings.HasSuffix(telegrafConf, "\n") {
+		telegrafConf += "\n"
+	}
+	return fmt.Sprintf("%s%s%s\n", telegrafConf, clientCertificateSerialComment, serial)
+}
+
+// sameTelegrafConf checks whether telegraf configurations are the same, ignoring the comment with serial number
+// of the client certificate, which is only added when the certificate is rotated.
+func sameTelegrafConf(a, b string) bool {
+	strip := func(telegrafConf string) string {
+		return strings.TrimRight(clientCertificateSerialCommentRegexp.ReplaceAllString(telegrafConf, ""), "\n")
+	}
+	return strip(a) == strip(b)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	testclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestCASecret creates a secret with a self-signed CA certificate.
+func newTestCASecret(t *testing.T) *corev1.Secret {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "client-ca", Namespace: "telegraf-operator"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+	}
+}
+
+func newTestClientCertIssuer(t *testing.T, validity time.Duration) *clientCertIssuer {
+	caSecret := newTestCASecret(t)
+	return &clientCertIssuer{
+		Client:   testclient.NewFakeClientWithScheme(scheme, caSecret),
+		CASecret: types.NamespacedName{Namespace: caSecret.Namespace, Name: caSecret.Name},
+		Validity: validity,
+	}
+}
+
+func parseTestCertificate(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("unable to decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// summarizeTestCertificates replaces generated client certificate data in the secret with the PEM block type and,
+// for certificates, the subject and issuer, so that the secret can be compared with expected YAML.
+func summarizeTestCertificates(t *testing.T, secret *corev1.Secret) *corev1.Secret {
+	secret = secret.DeepCopy()
+	for _, key := range []string{TelegrafSecretCertKey, TelegrafSecretKeyKey, TelegrafSecretCAKey} {
+		data, ok := secret.StringData[key]
+		if !ok {
+			continue
+		}
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			t.Fatalf("unable to decode %s", key)
+		}
+		summary := block.Type
+		if block.Type == "CERTIFICATE" {
+			cert := parseTestCertificate(t, []byte(data))
+			summary = fmt.Sprintf("%s subject=%s issuer=%s", block.Type, cert.Subject, cert.Issuer)
+		}
+		secret.StringData[key] = summary
+	}
+	return secret
+}
+
+func Test_clientCertificateSubject(t *testing.T) {
+	tests := []struct {
+		name     string
+		issuer   *clientCertIssuer
+		settings *classSettings
+		want     *pkix.Name
+		wantErr  bool
+	}{
+		{
+			name:     "disabled by default",
+			issuer:   &clientCertIssuer{},
+			settings: &classSettings{},
+		},
+		{
+			name:     "requires CA",
+			settings: &classSettings{ClientCertificate: ClientCertificateScopePod},
+			wantErr:  true,
+		},
+		{
+			name:     "pod scope",
+			issuer:   &clientCertIssuer{},
+			settings: &classSettings{ClientCertificate: ClientCertificateScopePod},
+			want:     &pkix.Name{Organization: []string{"mynamespace"}, OrganizationalUnit: []string{"StatefulSet"}, CommonName: "db-0"},
+		},
+		{
+			name:     "workload scope",
+			issuer:   &clientCertIssuer{},
+			settings: &classSettings{ClientCertificate: ClientCertificateScopeWorkload},
+			want:     &pkix.Name{Organization: []string{"mynamespace"}, OrganizationalUnit: []string{"StatefulSet"}, CommonName: "db"},
+		},
+		{
+			name:     "invalid scope",
+			issuer:   &clientCertIssuer{},
+			settings: &classSettings{ClientCertificate: "namespace"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{ClientCertIssuer: tt.issuer, Logger: testr.New(t)}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "db-0",
+					Namespace:       "mynamespace",
+					OwnerReferences: controllerRef("StatefulSet", "db"),
+				},
+			}
+
+			got, err := handler.clientCertificateSubject(pod, tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("clientCertificateSubject() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clientCertificateSubject() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clientCertIssuer_issue(t *testing.T) {
+	issuer := newTestClientCertIssuer(t, time.Hour)
+	subject := pkix.Name{Organization: []string{"mynamespace"}, OrganizationalUnit: []string{"Deployment"}, CommonName: "web"}
+
+	data, err := issuer.issue(context.Background(), subject)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := tls.X509KeyPair(data[TelegrafSecretCertKey], data[TelegrafSecretKeyKey]); err != nil {
+		t.Errorf("certificate does not match private key: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data[TelegrafSecretCAKey]) {
+		t.Fatalf("unable to parse CA certificate")
+	}
+	cert := parseTestCertificate(t, data[TelegrafSecretCertKey])
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("unable to verify client certificate: %v", err)
+	}
+	if got := cert.Subject.String(); got != subject.String() {
+		t.Errorf("unexpected subject %s, want %s", got, subject.String())
+	}
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity != time.Hour+clientCertificateBackdate {
+		t.Errorf("unexpected validity %s", validity)
+	}
+
+	issuer.CASecret.Name = "missing"
+	if _, err := issuer.issue(context.Background(), subject); err == nil {
+		t.Errorf("expected an error for missing CA secret, but none was reported")
+	}
+}
+
+func Test_clientCertRotator_rotate(t *testing.T) {
+	issuer := newTestClientCertIssuer(t, time.Hour)
+	subject := pkix.Name{Organization: []string{"mynamespace"}, CommonName: "web"}
+
+	newSecret := func(name string) *corev1.Secret {
+		data, err := issuer.issue(context.Background(), subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[TelegrafSecretDataKey] = []byte("[[outputs.file]]\n")
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "mynamespace",
+				Labels:    map[string]string{TelegrafSecretLabelClassName: "default", TelegrafSecretLabelPod: name},
+			},
+			Data: data,
+		}
+	}
+	first := newSecret("first")
+	second := newSecret("second")
+	withoutCertificate := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "without-certificate",
+			Namespace: "mynamespace",
+			Labels:    map[string]string{TelegrafSecretLabelClassName: "default", TelegrafSecretLabelPod: "without-certificate"},
+		},
+		Data: map[string][]byte{TelegrafSecretDataKey: []byte("[[outputs.file]]\n")},
+	}
+
+	clientset := fake.NewSimpleClientset(first, second, withoutCertificate)
+	rotator := newClientCertRotator(testr.New(t), clientset, issuer)
+
+	// certificates are rotated when checked 45 minutes after they were issued, with less than a third of their lifetime left
+	if err := rotator.rotate(context.Background(), time.Now().Add(45*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, secret := range []*corev1.Secret{first, second} {
+		got, err := clientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := parseTestCertificate(t, got.Data[TelegrafSecretCertKey])
+		if reflect.DeepEqual(got.Data[TelegrafSecretCertKey], secret.Data[TelegrafSecretCertKey]) {
+			t.Errorf("certificate in secret %s was not rotated", secret.Name)
+		}
+		if !strings.HasPrefix(string(got.Data[TelegrafSecretDataKey]), "[[outputs.file]]\n"+clientCertificateSerialComment) {
+			t.Errorf("unexpected telegraf configuration in secret %s: %s", secret.Name, got.Data[TelegrafSecretDataKey])
+		}
+		if cert.Subject.String() != subject.String() {
+			t.Errorf("unexpected subject %s", cert.Subject.String())
+		}
+	}
+
+	// rotated certificates have more than a third of their lifetime left, so they are not rotated again
+	rotated, err := clientset.CoreV1().Secrets("mynamespace").Get(context.Background(), "first", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotator.rotate(context.Background(), time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := clientset.CoreV1().Secrets("mynamespace").Get(context.Background(), "first", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Data, rotated.Data) {
+		t.Errorf("secret was updated even though certificate is not expiring")
+	}
+	if strings.Count(string(got.Data[TelegrafSecretDataKey]), clientCertificateSerialComment) != 1 {
+		t.Errorf("unexpected telegraf configuration: %s", got.Data[TelegrafSecretDataKey])
+	}
+
+	withoutCertificateGot, err := clientset.CoreV1().Secrets("mynamespace").Get(context.Background(), "without-certificate", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(withoutCertificateGot.Data, withoutCertificate.Data) {
+		t.Errorf("secret without certificate was updated")
+	}
+}
+
+func Test_clientCertRotator_rotate_continuesOnErrors(t *testing.T) {
+	issuer := newTestClientCertIssuer(t, time.Hour)
+
+	var objects []runtime.Object
+	for _, name := range []string{"first", "second"} {
+		data, err := issuer.issue(context.Background(), pkix.Name{CommonName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[TelegrafSecretDataKey] = []byte("[[outputs.file]]\n")
+		objects = append(objects, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "mynamespace",
+				Labels:    map[string]string{TelegrafSecretLabelClassName: "default", TelegrafSecretLabelPod: name},
+			},
+			Data: data,
+		})
+	}
+
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.UpdateAction).GetObject().(*corev1.Secret).Name == "first" {
+			return true, nil, fmt.Errorf("update failed")
+		}
+		return false, nil, nil
+	})
+	rotator := newClientCertRotator(testr.New(t), clientset, issuer)
+
+	if err := rotator.rotate(context.Background(), time.Now().Add(45*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := clientset.CoreV1().Secrets("mynamespace").Get(context.Background(), "second", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(got.Data[TelegrafSecretCertKey], objects[1].(*corev1.Secret).Data[TelegrafSecretCertKey]) {
+		t.Errorf("certificate was not rotated after failing to rotate another certificate")
+	}
+}
+
+func Test_sameTelegrafConf(t *testing.T) {
+	conf := "[[outputs.file]]"
+	if !sameTelegrafConf(withClientCertificateSerial(conf, nil), conf) {
+		t.Errorf("configurations differing only by client certificate serial should be the same")
+	}
+	if sameTelegrafConf(withClientCertificateSerial(conf, nil), "[[outputs.influxdb]]") {
+		t.Errorf("different configurations should not be the same")
+	}
+}
+
+func Test_withClientCertificateSerial(t *testing.T) {
+	conf := withClientCertificateSerial("[[outputs.file]]", nil)
+	conf = withClientCertificateSerial(conf, nil)
+	if want := "[[outputs.file]]\n" + clientCertificateSerialComment + "\n"; conf != want {
+		t.Errorf("withClientCertificateSerial() = %q, want %q", conf, want)
+	}
+}
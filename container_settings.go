@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// envNameRegexp matches valid names of environment variables of containers
+var envNameRegexp = regexp.MustCompile(`^[-._a-zA-Z][-._a-zA-Z0-9]*$`)
+
+// containerSettings describes settings of the telegraf sidecar container for a class; pod annotations take
+// precedence over them, while they take precedence over the operator defaults.
+type containerSettings struct {
+	// Image is the telegraf image to use
+	Image string `toml:"image"`
+	// RequestsCPU, RequestsMemory, LimitsCPU and LimitsMemory are resource requests and limits of the container
+	RequestsCPU    string `toml:"requests_cpu"`
+	RequestsMemory string `toml:"requests_memory"`
+	LimitsCPU      string `toml:"limits_cpu"`
+	LimitsMemory   string `toml:"limits_memory"`
+	// WatchConfig is the mode telegraf uses to watch for changes in configuration, inotify or poll
+	WatchConfig string `toml:"watch_config"`
+	// Env maps names of additional environment variables to their values
+	Env map[string]string `toml:"env"`
+}
+
+// validate checks that quantities, the watch config mode and names of environment variables are valid.
+func (s *containerSettings) validate() error {
+	for name, value := range map[string]string{
+		"requests_cpu":    s.RequestsCPU,
+		"requests_memory": s.RequestsMemory,
+		"limits_cpu":      s.LimitsCPU,
+		"limits_memory":   s.LimitsMemory,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return fmt.Errorf("invalid %s %s: %v", name, value, err)
+		}
+	}
+
+	switch s.WatchConfig {
+	case "", "inotify", "poll":
+	default:
+		return fmt.Errorf("invalid watch_config %s, expected inotify or poll", s.WatchConfig)
+	}
+
+	for name := range s.Env {
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// env returns additional environment variables of the container, sorted by name.
+func (s *containerSettings) env() []corev1.EnvVar {
+	env := make([]corev1.EnvVar, 0, len(s.Env))
+	for name, value := range s.Env {
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	return env
+}
+
+// customOrClassValue returns the value of the pod's annotation if it is set, the class value if it is not empty
+// or the operator default otherwise.
+func customOrClassValue(pod *corev1.Pod, annotation, classValue, defaultValue string) string {
+	if value, ok := pod.Annotations[annotation]; ok {
+		return value
+	}
+	return classOrDefaultValue(classValue, defaultValue)
+}
+
+// classOrDefaultValue returns the class value if it is not empty or the operator default otherwise.
+func classOrDefaultValue(classValue, defaultValue string) string {
+	if classValue != "" {
+		return classValue
+	}
+	return defaultValue
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_containerSettings_validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings containerSettings
+		wantErr  bool
+	}{
+		{
+			name: "empty settings",
+		},
+		{
+			name: "all settings",
+			settings: containerSettings{
+				Image:          "docker.io/library/telegraf:1.30",
+				RequestsCPU:    "100m",
+				RequestsMemory: "100Mi",
+				LimitsCPU:      "1",
+				LimitsMemory:   "1Gi",
+				WatchConfig:    "poll",
+				Env:            map[string]string{"INFLUX_BUCKET": "infra"},
+			},
+		},
+		{
+			name:     "invalid quantity",
+			settings: containerSettings{LimitsMemory: "1 GB"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid watch config",
+			settings: containerSettings{WatchConfig: "fsnotify"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid environment variable name",
+			settings: containerSettings{Env: map[string]string{"1BUCKET": "infra"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseClassData_containerSettings(t *testing.T) {
+	settings, _, err := parseClassData(`[telegraf_operator.container]
+  image = "docker.io/library/telegraf:1.30"
+  limits_memory = "1Gi"
+  [telegraf_operator.container.env]
+    INFLUX_BUCKET = "infra"
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &containerSettings{
+		Image:        "docker.io/library/telegraf:1.30",
+		LimitsMemory: "1Gi",
+		Env:          map[string]string{"INFLUX_BUCKET": "infra"},
+	}
+	if !reflect.DeepEqual(settings.Container, want) {
+		t.Errorf("parseClassData() container settings = %v, want %v", settings.Container, want)
+	}
+
+	if _, _, err := parseClassData("[telegraf_operator.container]\n  watch_config = \"always\"\n"); err == nil {
+		t.Errorf("expected an error for invalid container settings, but none was reported")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// downwardAPIFields maps names of environment variables that can be added to telegraf sidecars
+// to the pod fields exposed using the downward API.
+var downwardAPIFields = map[string]string{
+	"NODENAME":        "spec.nodeName",
+	"POD_NAME":        "metadata.name",
+	"POD_NAMESPACE":   "metadata.namespace",
+	"POD_UID":         "metadata.uid",
+	podIPEnv:          "status.podIP",
+	"HOST_IP":         "status.hostIP",
+	"SERVICE_ACCOUNT": "spec.serviceAccountName",
+}
+
+// labelEnvInvalidCharacters matches characters in label names that are not valid in environment variable names.
+var labelEnvInvalidCharacters = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// validateDownwardAPIEnv checks that all of the configured downward API environment variables are supported.
+func (h *sidecarHandler) validateDownwardAPIEnv() error {
+	for _, name := range h.DownwardAPIEnv {
+		if _, ok := downwardAPIFields[name]; !ok {
+			supported := make([]string, 0, len(downwardAPIFields))
+			for key := range downwardAPIFields {
+				supported = append(supported, key)
+			}
+			sort.Strings(supported)
+			return fmt.Errorf("unsupported downward API environment variable %s, supported: %s", name, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// downwardAPIEnv returns environment variables to add to telegraf sidecars. NODENAME is always added,
+// followed by variables configured in DownwardAPIEnv and variables for labels in DownwardAPILabels that
+// are set on the pod, such as LABEL_APP_KUBERNETES_IO_NAME for "app.kubernetes.io/name" label.
+func (h *sidecarHandler) downwardAPIEnv(pod *corev1.Pod) []corev1.EnvVar {
+	names := append([]string{"NODENAME"}, h.DownwardAPIEnv...)
+	if h.scrapesPodIP(pod) {
+		names = append(names, podIPEnv)
+	}
+
+	var env []corev1.EnvVar
+	added := map[string]bool{}
+	add := func(name, fieldPath string) {
+		if added[name] {
+			return
+		}
+		added[name] = true
+		env = append(env, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: fieldPath,
+				},
+			},
+		})
+	}
+
+	for _, name := range names {
+		add(name, downwardAPIFields[name])
+	}
+
+	for _, label := range h.DownwardAPILabels {
+		if _, ok := pod.Labels[label]; ok {
+			add(labelEnvName(label), fmt.Sprintf("metadata.labels['%s']", label))
+		}
+	}
+
+	return env
+}
+
+// labelEnvName converts label name to the name of environment variable it is passed as.
+func labelEnvName(label string) string {
+	return "LABEL_" + labelEnvInvalidCharacters.ReplaceAllString(strings.ToUpper(label), "_")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_validateDownwardAPIEnv(t *testing.T) {
+	if err := (&sidecarHandler{DownwardAPIEnv: []string{"POD_NAME", "POD_NAMESPACE", "NODENAME"}}).validateDownwardAPIEnv(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (&sidecarHandler{DownwardAPIEnv: []string{"POD_NAME", "NAMESPACE"}}).validateDownwardAPIEnv(); err == nil {
+		t.Errorf("expected an error, but none was reported")
+	}
+}
+
+func Test_downwardAPIEnv(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app.kubernetes.io/name": "myapp",
+				"team":                   "a",
+			},
+			Annotations: map[string]string{
+				TelegrafScrapeHost: ScrapeHostPodIP,
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		handler *sidecarHandler
+		want    map[string]string
+	}{
+		{
+			name:    "only NODENAME by default",
+			handler: &sidecarHandler{ScrapeHost: "127.0.0.1"},
+			want:    map[string]string{"NODENAME": "spec.nodeName"},
+		},
+		{
+			name: "configured variables and labels present on pod",
+			handler: &sidecarHandler{
+				ScrapeHost:        "127.0.0.1",
+				DownwardAPIEnv:    []string{"POD_NAME", "POD_NAMESPACE", "NODENAME", "SERVICE_ACCOUNT"},
+				DownwardAPILabels: []string{"app.kubernetes.io/name", "missing"},
+			},
+			want: map[string]string{
+				"NODENAME":                     "spec.nodeName",
+				"POD_NAME":                     "metadata.name",
+				"POD_NAMESPACE":                "metadata.namespace",
+				"SERVICE_ACCOUNT":              "spec.serviceAccountName",
+				"LABEL_APP_KUBERNETES_IO_NAME": "metadata.labels['app.kubernetes.io/name']",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := pod.DeepCopy()
+			delete(p.Annotations, TelegrafScrapeHost)
+
+			got := map[string]string{}
+			for _, env := range tt.handler.downwardAPIEnv(p) {
+				got[env.Name] = env.ValueFrom.FieldRef.FieldPath
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("downwardAPIEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// POD_IP is added only once when both configured and required by scrape host
+	handler := &sidecarHandler{DownwardAPIEnv: []string{podIPEnv}}
+	count := 0
+	for _, env := range handler.downwardAPIEnv(pod) {
+		if env.Name == podIPEnv {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected POD_IP to be added once, got %d", count)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/influxdata/telegraf-operator
 go 1.18
 
 require (
+	filippo.io/age v1.1.1
 	github.com/fsnotify/fsnotify v1.5.1
 	github.com/go-logr/logr v1.2.3
 	github.com/influxdata/toml v0.0.0-20180607005434-2a2e3012f7cf
@@ -12,6 +13,7 @@ require (
 	k8s.io/apiserver v0.25.16
 	k8s.io/client-go v0.25.16
 	sigs.k8s.io/controller-runtime v0.12.3
+	sigs.k8s.io/yaml v1.3.0
 )
 
 require (
@@ -86,5 +88,4 @@ require (
 	k8s.io/utils v0.0.0-20220728103510-ee6ede2d64ed // indirect
 	sigs.k8s.io/json v0.0.0-20220713155537-f223a00ba0e2 // indirect
 	sigs.k8s.io/structured-merge-diff/v4 v4.2.3 // indirect
-	sigs.k8s.io/yaml v1.3.0 // indirect
 )
@@ -42,6 +42,7 @@ type podInjector struct {
 	Logger                      logr.Logger
 	ClassDataHandler            *directoryClassDataHandler
 	SidecarHandler              *sidecarHandler
+	Policy                      *policyConfig
 	RequireAnnotationsForSecret bool
 }
 
@@ -119,6 +120,13 @@ func (a *podInjector) Handle(ctx context.Context, req admission.Request) admissi
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
+	if a.Policy != nil {
+		if err := a.Policy.check(req.Namespace, result); err != nil {
+			a.Logger.Info(fmt.Sprintf("rejecting pod: %v", err))
+			return admission.Errored(http.StatusForbidden, err)
+		}
+	}
+
 	if req.Operation == admv1.Create || req.Operation == admv1.Update {
 		err = a.createOrUpdateSecrets(ctx, result.secrets)
 		if err != nil {
@@ -202,8 +210,14 @@ func (a *podInjector) isSecretManagedByTelegrafOperator(secret *corev1.Secret) b
 		a.Logger.Info("assuming secret already exists and is not telegraf-matched as its type is not Opaque")
 		return false
 	}
-	// verify that the secret only contains the expected key
-	if len(secret.Data) != 1 || len(secret.Data[TelegrafSecretDataKey]) == 0 {
+	// verify that the secret only contains the expected keys
+	for key := range secret.Data {
+		if key != TelegrafSecretDataKey && key != TelegrafSecretCertKey && key != TelegrafSecretKeyKey && key != TelegrafSecretCAKey {
+			a.Logger.Info("assuming secret already exists and is not telegraf-matched as its data has non-standard keys")
+			return false
+		}
+	}
+	if len(secret.Data[TelegrafSecretDataKey]) == 0 {
 		a.Logger.Info("assuming secret already exists and is not telegraf-matched as its data has non-standard keys")
 		return false
 	}
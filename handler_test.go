@@ -56,6 +56,7 @@ func Test_podInjector_Handle(t *testing.T) {
 		req     admission.Request
 		want    want
 		handler *sidecarHandler
+		policy  *policyConfig
 	}{
 		{
 			name: "error if no pod in request",
@@ -222,6 +223,50 @@ func Test_podInjector_Handle(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "reject pod violating policy",
+			req: admission.Request{
+				AdmissionRequest: admv1.AdmissionRequest{
+					Operation: admv1.Create,
+					Namespace: "restricted",
+					Object: runtime.RawExtension{
+						Raw: []byte(`{
+								"apiVersion": "v1",
+								"kind": "Pod",
+								"metadata": {
+								  "name": "simple",
+								  "annotations": {
+									"telegraf.influxdata.com/port": "8080",
+									"telegraf.influxdata.com/image": "example.com/telegraf:latest"
+								  }
+								},
+								"spec": {
+								  "containers": [
+									{
+									  "name": "busybox",
+									  "image": "busybox"
+									}
+								  ]
+								}
+							  }`),
+					},
+				},
+			},
+			fields: fields{
+				TelegrafDefaultClass: testTelegrafClass,
+			},
+			classes: map[string]string{testTelegrafClass: sampleClassData},
+			policy: &policyConfig{
+				Namespaces: map[string]*namespacePolicy{
+					"restricted": {AllowedImages: []string{"docker.io/library/telegraf:*"}},
+				},
+			},
+			want: want{
+				Allowed: false,
+				Code:    http.StatusForbidden,
+				Message: `telegraf sidecar violates policy for namespace restricted: image "example.com/telegraf:latest" is not allowed`,
+			},
+		},
 		{
 			name: "inject telegraf with custom image passed as sidecar config into container",
 			req: admission.Request{
@@ -859,6 +904,7 @@ func Test_podInjector_Handle(t *testing.T) {
 				Logger:           logger,
 				SidecarHandler:   tt.handler,
 				ClassDataHandler: testClassDataHandler,
+				Policy:           tt.policy,
 			}
 
 			if tt.want.Code == 0 {
@@ -923,6 +969,28 @@ func Test_isSecretManagedByTelegrafOperator(t *testing.T) {
 			},
 			result: false,
 		},
+		{
+			name: "reports false when secret data has additional keys",
+			secret: &corev1.Secret{
+				Data: map[string][]byte{
+					TelegrafSecretDataKey: []byte("test"),
+					"invalid":             []byte("test"),
+				},
+			},
+			result: false,
+		},
+		{
+			name: "reports true when secret data has client certificate",
+			secret: &corev1.Secret{
+				Data: map[string][]byte{
+					TelegrafSecretDataKey: []byte("test"),
+					TelegrafSecretCertKey: []byte("cert"),
+					TelegrafSecretKeyKey:  []byte("key"),
+					TelegrafSecretCAKey:   []byte("ca"),
+				},
+			},
+			result: true,
+		},
 		{
 			name: "reports false when secret if type is not Opaque",
 			secret: &corev1.Secret{
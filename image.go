@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// imageResolver rewrites telegraf images before they are injected, allowing to pin tags to digests
+// without access to the registry, to use mirrors in air-gapped environments and to restrict which
+// images can be used.
+type imageResolver struct {
+	// Digests maps images to their digests, such as "docker.io/library/telegraf:1.22": "sha256:..."
+	Digests map[string]string `json:"digests,omitempty"`
+	// RegistryMirrors maps registries to the registry (and optional path prefix) to use instead,
+	// such as "docker.io": "mirror.example.com/docker.io"
+	RegistryMirrors map[string]string `json:"registryMirrors,omitempty"`
+	// AllowedImages lists patterns of images that can be used, where "*" matches any characters;
+	// all images are allowed if empty
+	AllowedImages []string `json:"allowedImages,omitempty"`
+}
+
+// loadImageResolver reads image resolver configuration from a YAML or JSON file.
+func loadImageResolver(filename string) (*imageResolver, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &imageResolver{}
+	if err := yaml.UnmarshalStrict(data, r); err != nil {
+		return nil, fmt.Errorf("unable to parse image resolver file %s: %v", filename, err)
+	}
+
+	return r, nil
+}
+
+// resolve returns the image that should be used instead of the specified one, returning
+// an error if the image is not allowed. Images are normalized so that "telegraf:1.22",
+// "docker.io/telegraf:1.22" and "docker.io/library/telegraf:1.22" are treated as the same image.
+func (r *imageResolver) resolve(image string) (string, error) {
+	image = normalizeImage(image)
+
+	if len(r.AllowedImages) > 0 && !matchesAnyPattern(image, r.AllowedImages) {
+		return "", fmt.Errorf("telegraf image %s is not allowed", image)
+	}
+
+	if digest, ok := r.Digests[image]; ok && !strings.Contains(image, "@") {
+		image = fmt.Sprintf("%s@%s", image, digest)
+	}
+
+	registry, rest := splitImageRegistry(image)
+	if mirror, ok := r.RegistryMirrors[registry]; ok {
+		image = fmt.Sprintf("%s/%s", strings.TrimSuffix(mirror, "/"), rest)
+	}
+
+	return image, nil
+}
+
+// normalizeImage adds the default registry and repository prefix to images that do not specify them,
+// following the same rules as container runtimes do.
+func normalizeImage(image string) string {
+	registry, rest := splitImageRegistry(image)
+	if registry != "docker.io" {
+		return image
+	}
+	if !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	return "docker.io/" + rest
+}
+
+// splitImageRegistry splits image into registry and the remaining part; the first component of an image is
+// only treated as a registry if it contains a "." or ":" or is "localhost", otherwise docker.io is assumed.
+func splitImageRegistry(image string) (string, string) {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], parts[1]
+	}
+	return "docker.io", image
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_imageResolver_resolve(t *testing.T) {
+	resolver := &imageResolver{
+		Digests: map[string]string{
+			"docker.io/library/telegraf:1.22": "sha256:0123456789abcdef",
+		},
+		RegistryMirrors: map[string]string{
+			"docker.io": "mirror.example.com/dockerhub/",
+		},
+		AllowedImages: []string{"docker.io/library/telegraf:*", "registry.example.com/*"},
+	}
+
+	tests := []struct {
+		name    string
+		image   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "short image name is pinned and mirrored",
+			image: "telegraf:1.22",
+			want:  "mirror.example.com/dockerhub/library/telegraf:1.22@sha256:0123456789abcdef",
+		},
+		{
+			name:  "full image name is pinned and mirrored",
+			image: "docker.io/library/telegraf:1.22",
+			want:  "mirror.example.com/dockerhub/library/telegraf:1.22@sha256:0123456789abcdef",
+		},
+		{
+			name:  "image on docker.io without repository prefix is pinned and mirrored",
+			image: "docker.io/telegraf:1.22",
+			want:  "mirror.example.com/dockerhub/library/telegraf:1.22@sha256:0123456789abcdef",
+		},
+		{
+			name:    "image on docker.io with repository prefix is not a library image",
+			image:   "docker.io/influxdata/telegraf:1.22",
+			wantErr: true,
+		},
+		{
+			name:  "image without digest is only mirrored",
+			image: "telegraf:1.23",
+			want:  "mirror.example.com/dockerhub/library/telegraf:1.23",
+		},
+		{
+			name:  "image from other registry is kept",
+			image: "registry.example.com/telegraf:1.22",
+			want:  "registry.example.com/telegraf:1.22",
+		},
+		{
+			name:    "image not on allow list is rejected",
+			image:   "quay.io/influxdb/telegraf:1.22",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolver.resolve(tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_shouldAddTelegrafSidecar_resolvedImage(t *testing.T) {
+	handler := &sidecarHandler{Logger: testr.New(t)}
+
+	// the annotation set by telegraf-operator itself should not cause the sidecar to be injected
+	resolvedOnly := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{TelegrafResolvedImagePrefix + "telegraf-istio": defaultTelegrafImage + "@sha256:0123456789abcdef"},
+		},
+	}
+	if handler.shouldAddTelegrafSidecar(resolvedOnly) {
+		t.Errorf("resolved image annotation should not cause sidecar to be added")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// inputsConfigMapIndex is the name of the index of secrets by the name of the ConfigMap they read inputs from
+const inputsConfigMapIndex = "telegraf.influxdata.com/inputs-configmap-name"
+
+// parseConfigMapKeyRef parses a reference to a key of a ConfigMap, specified as name/key.
+func parseConfigMapKeyRef(ref string) (name, key string, err error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid %s annotation %q, expected name/key", TelegrafInputsConfigMap, ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// inputsFromConfigMap returns custom inputs stored in a key of a ConfigMap in the pod's namespace.
+func (h *sidecarHandler) inputsFromConfigMap(namespace, ref string) (string, error) {
+	name, key, err := parseConfigMapKeyRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if h.Client == nil {
+		return "", fmt.Errorf("unable to get ConfigMap %s: no client configured", name)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err = h.Client.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, configMap)
+	if err != nil {
+		return "", fmt.Errorf("unable to get ConfigMap %s in namespace %s: %w", name, namespace, err)
+	}
+
+	inputsRaw, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("unable to get inputs from key %s of ConfigMap %s in namespace %s: %w", key, name, namespace, errConfigMapKeyNotFound)
+	}
+
+	return inputsRaw, nil
+}
+
+// inputsConfigMapReconciler updates secrets of pods that read their inputs from a ConfigMap whenever it changes.
+type inputsConfigMapReconciler struct {
+	updater *secretsUpdater
+}
+
+// errConfigMapKeyNotFound is returned if the key with inputs does not exist in the ConfigMap.
+var errConfigMapKeyNotFound = errors.New("key not found in ConfigMap")
+
+// setupInputsConfigMapController registers the controller updating secrets when ConfigMaps they read inputs from
+// change. Only metadata of ConfigMaps is cached, and only ConfigMaps referenced by secrets are reconciled.
+func setupInputsConfigMapController(ctx context.Context, mgr ctrl.Manager, updater *secretsUpdater) error {
+	// only metadata of secrets is indexed, so that contents of secrets in the cluster are not cached
+	err := mgr.GetFieldIndexer().IndexField(ctx, secretMetadata(), inputsConfigMapIndex, indexInputsConfigMap)
+	if err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.ConfigMap{}, builder.OnlyMetadata, builder.WithPredicates(referencedConfigMap(mgr.GetCache()))).
+		Complete(&inputsConfigMapReconciler{updater: updater})
+}
+
+// indexInputsConfigMap returns the name of the ConfigMap that a secret managed by telegraf-operator reads inputs from.
+func indexInputsConfigMap(obj client.Object) []string {
+	ref, ok := obj.GetAnnotations()[TelegrafInputsConfigMap]
+	if !ok {
+		return nil
+	}
+	name, _, err := parseConfigMapKeyRef(ref)
+	if err != nil {
+		return nil
+	}
+	return []string{name}
+}
+
+// secretMetadata returns an object for reading only metadata of secrets from the cache.
+func secretMetadata() *metav1.PartialObjectMetadata {
+	secret := &metav1.PartialObjectMetadata{}
+	secret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	return secret
+}
+
+// referencedConfigMap returns a predicate passing only ConfigMaps that secrets managed by telegraf-operator read
+// inputs from, using the index of secrets.
+func referencedConfigMap(reader client.Reader) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		secrets := &metav1.PartialObjectMetadataList{}
+		secrets.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("SecretList"))
+		err := reader.List(context.Background(), secrets,
+			client.InNamespace(obj.GetNamespace()),
+			client.MatchingFields{inputsConfigMapIndex: obj.GetName()},
+		)
+		// ConfigMaps are reconciled if the index can not be used, so that changes are not missed
+		return err != nil || len(secrets.Items) > 0
+	})
+}
+
+// Reconcile updates all secrets referencing the ConfigMap; it implements reconcile.Reconciler.
+// If the ConfigMap was deleted, secrets keep their current configuration until it is created again.
+func (r *inputsConfigMapReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	_, err := r.updater.clientset.CoreV1().ConfigMaps(req.Namespace).Get(ctx, req.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		r.updater.logger.Info("ConfigMap with inputs was deleted, not updating secrets referencing it", "namespace", req.Namespace, "name", req.Name)
+		return reconcile.Result{}, nil
+	} else if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	err = r.updater.updateSecrets(ctx, req.Namespace, func(secret *corev1.Secret) bool {
+		ref, ok := secret.GetAnnotations()[TelegrafInputsConfigMap]
+		if !ok {
+			return false
+		}
+		name, _, err := parseConfigMapKeyRef(ref)
+		return err == nil && name == req.Name
+	})
+	if err != nil {
+		r.updater.logger.Error(err, "unable to update secrets for ConfigMap", "namespace", req.Namespace, "name", req.Name)
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	testclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func Test_parseConfigMapKeyRef(t *testing.T) {
+	tests := []struct {
+		ref      string
+		wantName string
+		wantKey  string
+		wantErr  bool
+	}{
+		{ref: "inputs/redis.conf", wantName: "inputs", wantKey: "redis.conf"},
+		{ref: "inputs/", wantErr: true},
+		{ref: "/redis.conf", wantErr: true},
+		{ref: "inputs", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			name, key, err := parseConfigMapKeyRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseConfigMapKeyRef() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if name != tt.wantName || key != tt.wantKey {
+				t.Errorf("parseConfigMapKeyRef() = %v, %v, want %v, %v", name, key, tt.wantName, tt.wantKey)
+			}
+		})
+	}
+}
+
+func Test_assembleConf_inputsConfigMap(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "inputs", Namespace: "mynamespace"},
+		Data: map[string]string{
+			"redis.conf": "[[inputs.redis]]\n  servers = [\"tcp://localhost:6379\"]",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		objects     []runtime.Object
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "inputs are read from the ConfigMap",
+			annotations: map[string]string{
+				TelegrafInputsConfigMap: "inputs/redis.conf",
+			},
+			objects: []runtime.Object{configMap},
+			want: `
+[[inputs.redis]]
+  servers = ["tcp://localhost:6379"]
+`,
+		},
+		{
+			name: "inputs from the ConfigMap are added after inputs from the annotation",
+			annotations: map[string]string{
+				TelegrafRawInput:        "[[inputs.cpu]]",
+				TelegrafInputsConfigMap: "inputs/redis.conf",
+			},
+			objects: []runtime.Object{configMap},
+			want: `
+[[inputs.cpu]]
+[[inputs.redis]]
+  servers = ["tcp://localhost:6379"]
+`,
+		},
+		{
+			name: "missing key",
+			annotations: map[string]string{
+				TelegrafInputsConfigMap: "inputs/mysql.conf",
+			},
+			objects: []runtime.Object{configMap},
+			wantErr: true,
+		},
+		{
+			name: "missing ConfigMap",
+			annotations: map[string]string{
+				TelegrafInputsConfigMap: "inputs/redis.conf",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid reference",
+			annotations: map[string]string{
+				TelegrafInputsConfigMap: "inputs",
+			},
+			objects: []runtime.Object{configMap},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			_ = corev1.AddToScheme(scheme)
+
+			handler := &sidecarHandler{
+				ClassDataHandler: newMockClassDataHandler(map[string]string{"default": ""}),
+				Client:           testclient.NewFakeClientWithScheme(scheme, tt.objects...),
+				Logger:           testr.New(t),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "myname",
+					Namespace:   "mynamespace",
+					Annotations: tt.annotations,
+				},
+			}
+
+			conf, err := handler.assembleSidecarConf(pod, "default")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("assembleSidecarConf() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if strings.TrimSpace(conf.telegrafConf) != strings.TrimSpace(tt.want) {
+				t.Errorf("assembleSidecarConf() = %v, want %v", conf.telegrafConf, tt.want)
+			}
+			if conf.inputsConfigMap != tt.annotations[TelegrafInputsConfigMap] {
+				t.Errorf("inputsConfigMap = %v, want %v", conf.inputsConfigMap, tt.annotations[TelegrafInputsConfigMap])
+			}
+		})
+	}
+}
+
+func Test_inputsConfigMapReconciler(t *testing.T) {
+	test := newSecretsUpdaterTest(t)
+	test.pod1.Annotations[TelegrafInputsConfigMap] = "inputs/redis.conf"
+	test.secret1.Annotations = map[string]string{TelegrafInputsConfigMap: "inputs/redis.conf"}
+	test.pod2.Annotations[TelegrafInputsConfigMap] = "other/redis.conf"
+	test.secret2.Annotations = map[string]string{TelegrafInputsConfigMap: "other/redis.conf"}
+	test.secret1.Data[TelegrafSecretDataKey] = []byte("outdated")
+	test.createObjects()
+	createInputsConfigMap(t, test)
+
+	reconciler := &inputsConfigMapReconciler{updater: test.updater}
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: "ns1", Name: "inputs"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// only the secret referencing the ConfigMap is re-rendered
+	if want, got := "ns1.pod1.test", strings.Join(test.mockSidecar.get(), ";"); want != got {
+		t.Errorf("wrong configurations assembled; want=%q; got=%q", want, got)
+	}
+
+	secret, err := test.fakeClient.CoreV1().Secrets("ns1").Get(context.Background(), test.secret1.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := "ns1.pod1.test", string(secret.Data[TelegrafSecretDataKey]); want != got {
+		t.Errorf("secret not updated; want=%q; got=%q", want, got)
+	}
+}
+
+func Test_inputsConfigMapReconciler_deletedConfigMap(t *testing.T) {
+	test := newSecretsUpdaterTest(t)
+	test.pod1.Annotations[TelegrafInputsConfigMap] = "inputs/redis.conf"
+	test.secret1.Annotations = map[string]string{TelegrafInputsConfigMap: "inputs/redis.conf"}
+	test.secret1.Data[TelegrafSecretDataKey] = []byte("current")
+	test.createObjects()
+
+	reconciler := &inputsConfigMapReconciler{updater: test.updater}
+	result, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: "ns1", Name: "inputs"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Requeue || result.RequeueAfter != 0 {
+		t.Errorf("unexpected requeue for deleted ConfigMap: %+v", result)
+	}
+
+	// secrets keep their configuration until the ConfigMap is created again
+	if got := test.mockSidecar.get(); len(got) != 0 {
+		t.Errorf("unexpected configurations assembled: %v", got)
+	}
+	secret, err := test.fakeClient.CoreV1().Secrets("ns1").Get(context.Background(), test.secret1.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := "current", string(secret.Data[TelegrafSecretDataKey]); want != got {
+		t.Errorf("secret updated; want=%q; got=%q", want, got)
+	}
+}
+
+func Test_inputsConfigMapReconciler_policy(t *testing.T) {
+	test := newSecretsUpdaterTest(t)
+	test.pod1.Annotations[TelegrafInputsConfigMap] = "inputs/redis.conf"
+	test.pod1.Annotations[TelegrafRawInput] = "[[outputs.exec]]\n  command = [\"sh\"]\n"
+	test.secret1.Annotations = map[string]string{TelegrafInputsConfigMap: "inputs/redis.conf"}
+	test.secret1.Data[TelegrafSecretDataKey] = []byte("current")
+	test.createObjects()
+	createInputsConfigMap(t, test)
+	test.updater.policy = &policyConfig{Default: &namespacePolicy{DeniedInputs: []string{"exec"}}}
+
+	reconciler := &inputsConfigMapReconciler{updater: test.updater}
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: "ns1", Name: "inputs"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// configuration violating the policy is not written
+	secret, err := test.fakeClient.CoreV1().Secrets("ns1").Get(context.Background(), test.secret1.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := "current", string(secret.Data[TelegrafSecretDataKey]); want != got {
+		t.Errorf("secret updated; want=%q; got=%q", want, got)
+	}
+}
+
+func Test_indexInputsConfigMap(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name: "no annotation",
+		},
+		{
+			name:        "valid reference",
+			annotations: map[string]string{TelegrafInputsConfigMap: "inputs/redis.conf"},
+			want:        []string{"inputs"},
+		},
+		{
+			name:        "invalid reference",
+			annotations: map[string]string{TelegrafInputsConfigMap: "inputs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			if got := indexInputsConfigMap(secret); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("indexInputsConfigMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// indexedSecretsReader mocks a cache listing metadata of secrets by the inputsConfigMapIndex index.
+type indexedSecretsReader struct {
+	client.Reader
+	secrets []metav1.PartialObjectMetadata
+}
+
+func (r *indexedSecretsReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	for _, secret := range r.secrets {
+		if secret.Namespace != listOpts.Namespace {
+			continue
+		}
+		for _, name := range indexInputsConfigMap(&secret) {
+			if listOpts.FieldSelector.Matches(fields.Set{inputsConfigMapIndex: name}) {
+				list.(*metav1.PartialObjectMetadataList).Items = append(list.(*metav1.PartialObjectMetadataList).Items, secret)
+			}
+		}
+	}
+	return nil
+}
+
+func Test_referencedConfigMap(t *testing.T) {
+	reader := &indexedSecretsReader{secrets: []metav1.PartialObjectMetadata{
+		{ObjectMeta: metav1.ObjectMeta{
+			Name:        "telegraf-config-pod1",
+			Namespace:   "ns1",
+			Annotations: map[string]string{TelegrafInputsConfigMap: "inputs/redis.conf"},
+		}},
+	}}
+	predicate := referencedConfigMap(reader)
+
+	tests := []struct {
+		namespace string
+		name      string
+		want      bool
+	}{
+		{namespace: "ns1", name: "inputs", want: true},
+		{namespace: "ns1", name: "other", want: false},
+		{namespace: "ns2", name: "inputs", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.name, func(t *testing.T) {
+			configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: tt.name}}
+			if got := predicate.Generic(event.GenericEvent{Object: configMap}); got != tt.want {
+				t.Errorf("referencedConfigMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// createInputsConfigMap creates the ConfigMap referenced by secrets in tests of inputsConfigMapReconciler.
+func createInputsConfigMap(t *testing.T, test *secretsUpdaterTest) {
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "inputs", Namespace: "ns1"}}
+	if _, err := test.fakeClient.CoreV1().ConfigMaps("ns1").Create(context.Background(), configMap, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unable to create ConfigMap: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// listenerHost is the host that application containers use to send metrics to listeners in the sidecar
+const listenerHost = "localhost"
+
+// listenerPlugin describes an input plugin that listens for metrics pushed by application containers.
+type listenerPlugin struct {
+	// portName is the name of the sidecar's container port for the listener
+	portName    string
+	protocol    corev1.Protocol
+	defaultPort int32
+	// conf returns configuration of the input plugin listening on the port
+	conf func(port int32) string
+	// env returns environment variables telling application containers where to send metrics
+	env func(port int32) []corev1.EnvVar
+}
+
+// listenerPlugins lists input plugins that can be enabled using the listeners annotation, by plugin name.
+var listenerPlugins = map[string]listenerPlugin{
+	"statsd": {
+		portName:    "statsd",
+		protocol:    corev1.ProtocolUDP,
+		defaultPort: 8125,
+		conf: func(port int32) string {
+			return fmt.Sprintf("[[inputs.statsd]]\n  protocol = \"udp\"\n  service_address = \":%d\"\n", port)
+		},
+		env: func(port int32) []corev1.EnvVar {
+			return []corev1.EnvVar{
+				{Name: "STATSD_HOST", Value: listenerHost},
+				{Name: "STATSD_PORT", Value: strconv.Itoa(int(port))},
+			}
+		},
+	},
+	"influxdb_listener": {
+		portName:    "influxdb",
+		protocol:    corev1.ProtocolTCP,
+		defaultPort: 8186,
+		conf: func(port int32) string {
+			return fmt.Sprintf("[[inputs.influxdb_listener]]\n  service_address = \":%d\"\n", port)
+		},
+		env: func(port int32) []corev1.EnvVar {
+			return []corev1.EnvVar{
+				{Name: "INFLUX_HOST", Value: fmt.Sprintf("http://%s:%d", listenerHost, port)},
+			}
+		},
+	},
+	"opentelemetry": {
+		portName:    "otlp-grpc",
+		protocol:    corev1.ProtocolTCP,
+		defaultPort: 4317,
+		conf: func(port int32) string {
+			return fmt.Sprintf("[[inputs.opentelemetry]]\n  service_address = \":%d\"\n", port)
+		},
+		env: func(port int32) []corev1.EnvVar {
+			return []corev1.EnvVar{
+				{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Value: fmt.Sprintf("http://%s:%d", listenerHost, port)},
+				{Name: "OTEL_EXPORTER_OTLP_PROTOCOL", Value: "grpc"},
+			}
+		},
+	},
+}
+
+// listener is a listener input plugin enabled for a pod, along with the port it listens on.
+type listener struct {
+	name string
+	port int32
+	listenerPlugin
+}
+
+// parseListeners parses listeners enabled using the pod's annotation, specified as a comma separated list
+// of plugin names with optional ports, such as "statsd,opentelemetry:4318"; an error is returned if a port
+// is already used by another listener or by one of the pod's containers.
+func parseListeners(pod *corev1.Pod) ([]listener, error) {
+	listenersRaw, ok := pod.Annotations[TelegrafListeners]
+	if !ok {
+		return nil, nil
+	}
+
+	var listeners []listener
+	for _, item := range splitList(listenersRaw) {
+		name, portRaw, hasPort := strings.Cut(item, ":")
+		plugin, ok := listenerPlugins[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid %s annotation: unknown listener %s", TelegrafListeners, name)
+		}
+
+		port := plugin.defaultPort
+		if hasPort {
+			number, err := strconv.ParseInt(portRaw, 10, 32)
+			if err != nil || number < 1 || number > 65535 {
+				return nil, fmt.Errorf("invalid %s annotation: invalid port %s for listener %s", TelegrafListeners, portRaw, name)
+			}
+			port = int32(number)
+		}
+
+		for _, l := range listeners {
+			if l.name == name {
+				return nil, fmt.Errorf("invalid %s annotation: listener %s specified more than once", TelegrafListeners, name)
+			}
+			if l.port == port && l.protocol == plugin.protocol {
+				return nil, fmt.Errorf("invalid %s annotation: listeners %s and %s both use port %d", TelegrafListeners, l.name, name, port)
+			}
+		}
+		for _, container := range pod.Spec.Containers {
+			if isSidecarContainerName(container.Name) {
+				continue
+			}
+			for _, containerPort := range container.Ports {
+				if containerPort.ContainerPort == port && protocolOrDefault(containerPort.Protocol) == plugin.protocol {
+					return nil, fmt.Errorf("invalid %s annotation: port %d of listener %s is already used by container %s", TelegrafListeners, port, name, container.Name)
+				}
+			}
+		}
+
+		listeners = append(listeners, listener{name: name, port: port, listenerPlugin: plugin})
+	}
+
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].name < listeners[j].name })
+	return listeners, nil
+}
+
+// listenersInputs returns configuration of all listener input plugins.
+func listenersInputs(listeners []listener) string {
+	inputs := ""
+	for _, l := range listeners {
+		inputs = fmt.Sprintf("%s%s", inputs, l.conf(l.port))
+	}
+	return inputs
+}
+
+// listenersPorts returns named container ports of the sidecar for all listeners.
+func listenersPorts(listeners []listener) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, l := range listeners {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          l.portName,
+			ContainerPort: l.port,
+			Protocol:      l.protocol,
+		})
+	}
+	return ports
+}
+
+// addListenersEnv passes endpoints of all listeners to application containers as environment variables;
+// variables already set in a container are not overridden.
+func addListenersEnv(pod *corev1.Pod, listeners []listener) {
+	for i, container := range pod.Spec.Containers {
+		if isSidecarContainerName(container.Name) {
+			continue
+		}
+		for _, l := range listeners {
+			for _, env := range l.env(l.port) {
+				if !containerHasEnv(container, env.Name) {
+					pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, env)
+				}
+			}
+		}
+	}
+}
+
+// isSidecarContainerName checks whether the container is one of the sidecars added by telegraf-operator.
+func isSidecarContainerName(name string) bool {
+	return name == "telegraf" || name == "telegraf-istio"
+}
+
+// containerHasEnv checks whether the environment variable is set in the container.
+func containerHasEnv(container corev1.Container, name string) bool {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolOrDefault returns the protocol of a container port, which defaults to TCP.
+func protocolOrDefault(protocol corev1.Protocol) corev1.Protocol {
+	if protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return protocol
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/toml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseListeners(t *testing.T) {
+	tests := []struct {
+		name       string
+		listeners  string
+		containers []corev1.Container
+		want       map[string]int32
+		wantErr    bool
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name:      "default ports",
+			listeners: "statsd, influxdb_listener, opentelemetry",
+			want:      map[string]int32{"statsd": 8125, "influxdb_listener": 8186, "opentelemetry": 4317},
+		},
+		{
+			name:      "custom port",
+			listeners: "opentelemetry:4318",
+			want:      map[string]int32{"opentelemetry": 4318},
+		},
+		{
+			name:      "same port with different protocols",
+			listeners: "statsd:8186,influxdb_listener",
+			want:      map[string]int32{"statsd": 8186, "influxdb_listener": 8186},
+		},
+		{
+			name:      "container port with different protocol",
+			listeners: "statsd",
+			containers: []corev1.Container{
+				{Name: "app", Ports: []corev1.ContainerPort{{ContainerPort: 8125}}},
+			},
+			want: map[string]int32{"statsd": 8125},
+		},
+		{
+			name:      "ports of the sidecar are ignored",
+			listeners: "influxdb_listener",
+			containers: []corev1.Container{
+				{Name: "telegraf", Ports: []corev1.ContainerPort{{Name: "influxdb", ContainerPort: 8186}}},
+			},
+			want: map[string]int32{"influxdb_listener": 8186},
+		},
+		{
+			name:      "unknown listener",
+			listeners: "syslog",
+			wantErr:   true,
+		},
+		{
+			name:      "invalid port",
+			listeners: "statsd:99999",
+			wantErr:   true,
+		},
+		{
+			name:      "duplicate listener",
+			listeners: "statsd,statsd:8126",
+			wantErr:   true,
+		},
+		{
+			name:      "port used by another listener",
+			listeners: "influxdb_listener:4317,opentelemetry",
+			wantErr:   true,
+		},
+		{
+			name:      "port used by a container",
+			listeners: "opentelemetry",
+			containers: []corev1.Container{
+				{Name: "collector", Ports: []corev1.ContainerPort{{ContainerPort: 4317, Protocol: corev1.ProtocolTCP}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+				Spec:       corev1.PodSpec{Containers: tt.containers},
+			}
+			if tt.listeners != "" {
+				pod.Annotations[TelegrafListeners] = tt.listeners
+			}
+
+			listeners, err := parseListeners(pod)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseListeners() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var got map[string]int32
+			for _, l := range listeners {
+				if got == nil {
+					got = map[string]int32{}
+				}
+				got[l.name] = l.port
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseListeners() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_listenersInputs(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{TelegrafListeners: "statsd,opentelemetry:4318,influxdb_listener"},
+		},
+	}
+	listeners, err := parseListeners(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := listenersInputs(listeners)
+	want := `[[inputs.influxdb_listener]]
+  service_address = ":8186"
+[[inputs.opentelemetry]]
+  service_address = ":4318"
+[[inputs.statsd]]
+  protocol = "udp"
+  service_address = ":8125"
+`
+	if got != want {
+		t.Errorf("listenersInputs() = %v, want %v", got, want)
+	}
+	if _, err := toml.Parse([]byte(got)); err != nil {
+		t.Errorf("listenersInputs() returned invalid TOML: %v", err)
+	}
+}
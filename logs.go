@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// logsPath is the directory in which the volume with logs of application containers is mounted in the sidecar;
+	// logs of each container are available in a subdirectory named after the container
+	logsPath = "/var/run/telegraf/logs"
+
+	LogsFormatJSON   = "json"
+	LogsFormatLogfmt = "logfmt"
+	LogsFormatGrok   = "grok"
+
+	defaultLogsFiles = "*.log"
+)
+
+// logsSettings describes how logs of an application container are collected.
+type logsSettings struct {
+	// Path is the directory in the application container that it writes logs to
+	Path string `json:"path"`
+	// Format is the data format of the logs - json, logfmt or grok
+	Format string `json:"format"`
+	// Files is the pattern of log files in the directory, defaults to *.log
+	Files string `json:"files,omitempty"`
+	// GrokPatterns are patterns used for parsing logs in grok format
+	GrokPatterns []string `json:"grokPatterns,omitempty"`
+}
+
+// parseLogsSettings parses and validates settings of log collection from the pod's annotation, returning
+// settings for each application container; nil is returned if log collection is not enabled for the pod.
+func parseLogsSettings(pod *corev1.Pod) (map[string]logsSettings, error) {
+	logsRaw, ok := pod.Annotations[TelegrafLogs]
+	if !ok {
+		return nil, nil
+	}
+
+	logs := map[string]logsSettings{}
+	if err := json.Unmarshal([]byte(logsRaw), &logs); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", TelegrafLogs, err)
+	}
+
+	for containerName, settings := range logs {
+		if !podHasContainerName(pod, containerName) {
+			return nil, fmt.Errorf("invalid %s annotation: container %s not found in the pod", TelegrafLogs, containerName)
+		}
+		if !path.IsAbs(settings.Path) {
+			return nil, fmt.Errorf("invalid %s annotation: path for container %s must be absolute, %q given", TelegrafLogs, containerName, settings.Path)
+		}
+		switch settings.Format {
+		case LogsFormatJSON, LogsFormatLogfmt:
+		case LogsFormatGrok:
+			if len(settings.GrokPatterns) == 0 {
+				return nil, fmt.Errorf("invalid %s annotation: grok patterns for container %s must be specified", TelegrafLogs, containerName)
+			}
+		default:
+			return nil, fmt.Errorf("invalid %s annotation: format for container %s must be one of %s, %s or %s, %q given",
+				TelegrafLogs, containerName, LogsFormatJSON, LogsFormatLogfmt, LogsFormatGrok, settings.Format)
+		}
+		if settings.Files == "" {
+			settings.Files = defaultLogsFiles
+		} else if strings.Contains(settings.Files, "..") || path.IsAbs(settings.Files) {
+			return nil, fmt.Errorf("invalid %s annotation: files for container %s must be relative to its path, %q given", TelegrafLogs, containerName, settings.Files)
+		}
+		logs[containerName] = settings
+	}
+
+	return logs, nil
+}
+
+// logsInputs returns [[inputs.tail]] configuration reading logs of all application containers, tagged with
+// the name of the container.
+func logsInputs(logs map[string]logsSettings) string {
+	containerNames := make([]string, 0, len(logs))
+	for containerName := range logs {
+		containerNames = append(containerNames, containerName)
+	}
+	sort.Strings(containerNames)
+
+	inputs := ""
+	for _, containerName := range containerNames {
+		settings := logs[containerName]
+		inputs = fmt.Sprintf("%s[[inputs.tail]]\n  files = [%s]\n  data_format = %s\n",
+			inputs, tomlString(path.Join(logsPath, containerName, settings.Files)), tomlString(settings.Format))
+		switch settings.Format {
+		case LogsFormatJSON:
+			// the JSON parser only keeps numeric fields unless string fields are listed
+			inputs = fmt.Sprintf("%s  json_string_fields = [\"*\"]\n", inputs)
+		case LogsFormatGrok:
+			patterns := make([]string, 0, len(settings.GrokPatterns))
+			for _, pattern := range settings.GrokPatterns {
+				patterns = append(patterns, tomlString(pattern))
+			}
+			inputs = fmt.Sprintf("%s  grok_patterns = [%s]\n", inputs, strings.Join(patterns, ", "))
+		}
+		inputs = fmt.Sprintf("%s  [inputs.tail.tags]\n    container_name = %s\n", inputs, tomlString(containerName))
+	}
+
+	return inputs
+}
+
+// logsVolumeName returns name of the volume shared by application containers and the sidecar for collecting logs.
+func logsVolumeName(containerName string) string {
+	return fmt.Sprintf("%s-logs", containerName)
+}
+
+// addLogsVolumeMounts mounts the logs volume in application containers, each using a subdirectory named after
+// the container, so that the sidecar can read logs of all containers.
+func addLogsVolumeMounts(pod *corev1.Pod, containerName string, logs map[string]logsSettings) {
+	for i, container := range pod.Spec.Containers {
+		settings, ok := logs[container.Name]
+		if !ok {
+			continue
+		}
+		pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      logsVolumeName(containerName),
+			MountPath: settings.Path,
+			SubPath:   container.Name,
+		})
+	}
+}
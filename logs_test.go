@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/toml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseLogsSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		logs    string
+		want    map[string]logsSettings
+		wantErr bool
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name: "default files",
+			logs: `{"app": {"path": "/var/log/app", "format": "json"}}`,
+			want: map[string]logsSettings{
+				"app": {Path: "/var/log/app", Format: "json", Files: "*.log"},
+			},
+		},
+		{
+			name: "grok with patterns",
+			logs: `{"app": {"path": "/var/log/app", "format": "grok", "files": "access.log", "grokPatterns": ["%{COMBINED_LOG_FORMAT}"]}}`,
+			want: map[string]logsSettings{
+				"app": {Path: "/var/log/app", Format: "grok", Files: "access.log", GrokPatterns: []string{"%{COMBINED_LOG_FORMAT}"}},
+			},
+		},
+		{
+			name:    "invalid JSON",
+			logs:    `{"app": "/var/log/app"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown container",
+			logs:    `{"other": {"path": "/var/log/app", "format": "json"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "relative path",
+			logs:    `{"app": {"path": "log", "format": "json"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			logs:    `{"app": {"path": "/var/log/app", "format": "csv"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "grok without patterns",
+			logs:    `{"app": {"path": "/var/log/app", "format": "grok"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "files outside of path",
+			logs:    `{"app": {"path": "/var/log/app", "format": "json", "files": "../*.log"}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			}
+			if tt.logs != "" {
+				pod.Annotations[TelegrafLogs] = tt.logs
+			}
+
+			got, err := parseLogsSettings(pod)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseLogsSettings() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLogsSettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_logsInputs(t *testing.T) {
+	got := logsInputs(map[string]logsSettings{
+		"nginx": {Path: "/var/log/nginx", Format: "grok", Files: "access.log", GrokPatterns: []string{"%{COMBINED_LOG_FORMAT}"}},
+		"app":   {Path: "/var/log/app", Format: "json", Files: "*.log"},
+		"proxy": {Path: "/var/log/proxy", Format: "logfmt", Files: "*.log"},
+	})
+	want := `[[inputs.tail]]
+  files = ["/var/run/telegraf/logs/app/*.log"]
+  data_format = "json"
+  json_string_fields = ["*"]
+  [inputs.tail.tags]
+    container_name = "app"
+[[inputs.tail]]
+  files = ["/var/run/telegraf/logs/nginx/access.log"]
+  data_format = "grok"
+  grok_patterns = ["%{COMBINED_LOG_FORMAT}"]
+  [inputs.tail.tags]
+    container_name = "nginx"
+[[inputs.tail]]
+  files = ["/var/run/telegraf/logs/proxy/*.log"]
+  data_format = "logfmt"
+  [inputs.tail.tags]
+    container_name = "proxy"
+`
+	if got != want {
+		t.Errorf("logsInputs() = %v, want %v", got, want)
+	}
+	if _, err := toml.Parse([]byte(got)); err != nil {
+		t.Errorf("logsInputs() returned invalid TOML: %v", err)
+	}
+}
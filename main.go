@@ -17,10 +17,16 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -51,6 +57,17 @@ func init() {
 	// +kubebuilder:scaffold:scheme
 }
 
+// splitList splits a comma separated command line option into a list, skipping empty values.
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
@@ -73,6 +90,19 @@ func main() {
 	var istioTelegrafRequestsMemory string
 	var istioTelegrafLimitsCPU string
 	var istioTelegrafLimitsMemory string
+	var policyFile string
+	var resourcesProfilesFile string
+	var imageResolverFile string
+	var classesAgeKeyFile string
+	var clientCASecret string
+	var clientCertValidity time.Duration
+	var enableScrapeDiscovery bool
+	var scrapeHost string
+	var downwardAPIEnv string
+	var enableMetadataTags bool
+	var metadataTagsLabels string
+	var downwardAPILabels string
+	var scrapeDiscoveryPortNames string
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
@@ -99,6 +129,26 @@ func main() {
 	flag.StringVar(&istioTelegrafRequestsMemory, "istio-ttelegraf-requests-memory", defaultRequestsMemory, "Default requests for memory for istio sidecar")
 	flag.StringVar(&istioTelegrafLimitsCPU, "istio-ttelegraf-limits-cpu", defaultLimitsCPU, "Default limits for CPU for istio sidecar")
 	flag.StringVar(&istioTelegrafLimitsMemory, "istio-ttelegraf-limits-memory", defaultLimitsMemory, "Default limits for memory for istio sidecar")
+	flag.BoolVar(&enableMetadataTags, "enable-metadata-tags", false,
+		"Add namespace, pod, node and owning workload of the pod as global tags for all classes; can be overridden per class")
+	flag.StringVar(&metadataTagsLabels, "metadata-tags-labels", "",
+		"Comma separated list of pod labels to add as global tags when metadata tags are enabled")
+	flag.StringVar(&downwardAPIEnv, "telegraf-downward-api-env", "POD_NAME,POD_NAMESPACE",
+		"Comma separated list of environment variables to add to all sidecars using downward API, in addition to NODENAME; supported: POD_NAME, POD_NAMESPACE, POD_UID, POD_IP, HOST_IP, SERVICE_ACCOUNT")
+	flag.StringVar(&downwardAPILabels, "telegraf-downward-api-labels", "",
+		"Comma separated list of pod labels to add to all sidecars as LABEL_<NAME> environment variables, such as app.kubernetes.io/name")
+	flag.StringVar(&scrapeHost, "telegraf-scrape-host", "127.0.0.1",
+		"Default host to scrape metrics from, such as 127.0.0.1, [::1], localhost; pod-ip or pod-ipv6 scrape the pod's IP address")
+	flag.BoolVar(&enableScrapeDiscovery, "enable-scrape-discovery", false,
+		"Enable scraping pods based on prometheus.io annotations and named container ports, without requiring telegraf-operator annotations")
+	flag.StringVar(&scrapeDiscoveryPortNames, "scrape-discovery-port-names", "metrics,*-metrics",
+		"Comma separated list of container port name patterns to scrape when scrape discovery is enabled, where * matches any characters")
+	flag.StringVar(&clientCASecret, "telegraf-client-ca-secret", "", "Optional namespace/name of a TLS secret with the CA used for signing client certificates of telegraf sidecars")
+	flag.DurationVar(&clientCertValidity, "telegraf-client-cert-validity", defaultClientCertificateValidity, "Validity of client certificates issued for telegraf sidecars")
+	flag.StringVar(&classesAgeKeyFile, "telegraf-classes-age-key-file", "", "Optional file with age keys used for decrypting SOPS or age encrypted class data")
+	flag.StringVar(&imageResolverFile, "telegraf-image-resolver-file", "", "Optional YAML or JSON file with image digests, registry mirrors and allowed images used when injecting telegraf sidecars")
+	flag.StringVar(&resourcesProfilesFile, "telegraf-resources-profiles-file", "", "Optional YAML or JSON file with named profiles of resources and agent buffer settings that pods may select using the resources-profile annotation")
+	flag.StringVar(&policyFile, "telegraf-policy-file", "", "Optional YAML or JSON file restricting images, input plugins, classes and resources that pods may use, per namespace")
 
 	zopts := zap.Options{
 		Development: true,
@@ -109,6 +159,12 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&zopts)))
 	entryLog := setupLog.WithName("entrypoint")
+
+	if err := validateScrapeHost(strings.TrimSpace(scrapeHost)); err != nil {
+		setupLog.Error(err, "invalid --telegraf-scrape-host option")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -132,6 +188,13 @@ func main() {
 	logger := setupLog.WithName("podInjector")
 
 	classData := newDirectoryClassDataHandler(logger, telegrafClassesDirectory)
+	if classesAgeKeyFile != "" {
+		classData.Identities, err = loadAgeIdentities(classesAgeKeyFile)
+		if err != nil {
+			setupLog.Error(err, "loading age keys failed")
+			os.Exit(1)
+		}
+	}
 
 	err = classData.validateClassData()
 	if err != nil {
@@ -139,8 +202,44 @@ func main() {
 		os.Exit(1)
 	}
 
+	var resolver *imageResolver
+	if imageResolverFile != "" {
+		resolver, err = loadImageResolver(imageResolverFile)
+		if err != nil {
+			setupLog.Error(err, "loading image resolver failed")
+			os.Exit(1)
+		}
+	}
+
+	var profiles map[string]*resourcesProfile
+	if resourcesProfilesFile != "" {
+		profiles, err = loadResourcesProfiles(resourcesProfilesFile)
+		if err != nil {
+			setupLog.Error(err, "loading resources profiles failed")
+			os.Exit(1)
+		}
+	}
+
+	var certIssuer *clientCertIssuer
+	if clientCASecret != "" {
+		parts := strings.SplitN(clientCASecret, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			setupLog.Error(fmt.Errorf("invalid value %s, expected namespace/name", clientCASecret), "parsing client CA secret failed")
+			os.Exit(1)
+		}
+		certIssuer = &clientCertIssuer{
+			Client:   mgr.GetAPIReader(),
+			CASecret: types.NamespacedName{Namespace: parts[0], Name: parts[1]},
+			Validity: clientCertValidity,
+		}
+	}
+
 	sidecar := &sidecarHandler{
 		ClassDataHandler:            classData,
+		Client:                      mgr.GetAPIReader(),
+		ImageResolver:               resolver,
+		ClientCertIssuer:            certIssuer,
+		ResourcesProfiles:           profiles,
 		Logger:                      logger,
 		TelegrafDefaultClass:        defaultTelegrafClass,
 		TelegrafImage:               telegrafImage,
@@ -158,6 +257,13 @@ func main() {
 		IstioRequestsMemory:         istioTelegrafRequestsMemory,
 		IstioLimitsCPU:              istioTelegrafLimitsCPU,
 		IstioLimitsMemory:           istioTelegrafLimitsMemory,
+		EnableScrapeDiscovery:       enableScrapeDiscovery,
+		ScrapeDiscoveryPortNames:    splitList(scrapeDiscoveryPortNames),
+		ScrapeHost:                  scrapeHost,
+		DownwardAPIEnv:              splitList(downwardAPIEnv),
+		DownwardAPILabels:           splitList(downwardAPILabels),
+		EnableMetadataTags:          enableMetadataTags,
+		MetadataTagsLabels:          splitList(metadataTagsLabels),
 	}
 
 	err = sidecar.validateRequestsAndLimits()
@@ -166,7 +272,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	updater, err := newSecretsUpdater(ctrl.Log.WithName("updater"), sidecar)
+	err = sidecar.validateDownwardAPIEnv()
+	if err != nil {
+		setupLog.Error(err, "downward API environment validation failed")
+		os.Exit(1)
+	}
+
+	var policy *policyConfig
+	if policyFile != "" {
+		policy, err = loadPolicyConfig(policyFile)
+		if err != nil {
+			setupLog.Error(err, "loading policy failed")
+			os.Exit(1)
+		}
+	}
+
+	updater, err := newSecretsUpdater(ctrl.Log.WithName("updater"), sidecar, policy)
 	if err != nil {
 		setupLog.Error(err, "setting up secrets updater failed")
 		os.Exit(1)
@@ -178,10 +299,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = setupInputsConfigMapController(context.Background(), mgr, updater)
+	if err != nil {
+		setupLog.Error(err, "setting up ConfigMap controller failed")
+		os.Exit(1)
+	}
+
+	if certIssuer != nil {
+		clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			setupLog.Error(err, "setting up client certificate rotator failed")
+			os.Exit(1)
+		}
+		if err := mgr.Add(newClientCertRotator(ctrl.Log.WithName("rotator"), clientset, certIssuer)); err != nil {
+			setupLog.Error(err, "setting up client certificate rotator failed")
+			os.Exit(1)
+		}
+	}
+
 	hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &podInjector{
 		Logger:                      logger,
 		SidecarHandler:              sidecar,
 		ClassDataHandler:            classData,
+		Policy:                      policy,
 		RequireAnnotationsForSecret: requireAnnotationsForSecret,
 	}})
 
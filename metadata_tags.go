@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// metadataTagsEnabled checks whether Kubernetes metadata global tags should be added, with class settings
+// taking precedence over the operator default.
+func (h *sidecarHandler) metadataTagsEnabled(settings *classSettings) bool {
+	if settings.MetadataTags != nil {
+		return *settings.MetadataTags
+	}
+	return h.EnableMetadataTags
+}
+
+// metadataTags returns global tags describing the pod - its namespace, name, node, the workload that owns it
+// and values of labels configured for the operator and the class.
+func (h *sidecarHandler) metadataTags(pod *corev1.Pod, settings *classSettings) map[string]string {
+	tags := map[string]string{
+		"namespace": pod.Namespace,
+		"pod":       pod.Name,
+		// node is not known when the pod is created, use the environment variable set for all sidecars
+		"node": "${NODENAME}",
+	}
+
+	if kind, name := h.podWorkload(pod); kind != "" {
+		tags["workload_kind"] = kind
+		tags["workload_name"] = name
+	}
+
+	for _, label := range append(append([]string{}, h.MetadataTagsLabels...), settings.MetadataTagsLabels...) {
+		if value, ok := pod.Labels[label]; ok {
+			tags[label] = value
+		}
+	}
+
+	return tags
+}
+
+// classGlobalTags returns names of tags set in the [global_tags] table of class data.
+func classGlobalTags(classData string) map[string]bool {
+	names := map[string]bool{}
+	tbl, err := toml.Parse([]byte(classData))
+	if err != nil {
+		return names
+	}
+	if globalTags, ok := tbl.Fields["global_tags"].(*ast.Table); ok {
+		for name := range globalTags.Fields {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// podWorkload returns kind and name of the workload that owns the pod, resolving ReplicaSets to Deployments
+// and Jobs to CronJobs that own them; if the owner can not be retrieved, the pod's direct owner is returned.
+func (h *sidecarHandler) podWorkload(pod *corev1.Pod) (string, string) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", ""
+	}
+
+	var object client.Object
+	switch owner.Kind {
+	case "ReplicaSet":
+		object = &appsv1.ReplicaSet{}
+	case "Job":
+		object = &batchv1.Job{}
+	default:
+		return owner.Kind, owner.Name
+	}
+
+	if h.Client == nil {
+		return owner.Kind, owner.Name
+	}
+
+	err := h.Client.Get(context.Background(), types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}, object)
+	if err != nil {
+		h.Logger.Info(fmt.Sprintf("unable to get %s %s/%s: %v", owner.Kind, pod.Namespace, owner.Name, err))
+		return owner.Kind, owner.Name
+	}
+
+	if parent := metav1.GetControllerOf(object); parent != nil {
+		return parent.Kind, parent.Name
+	}
+
+	return owner.Kind, owner.Name
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func controllerRef(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func Test_metadataTags(t *testing.T) {
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f7",
+			Namespace:       "mynamespace",
+			OwnerReferences: controllerRef("Deployment", "web"),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		owners   []metav1.OwnerReference
+		labels   map[string]string
+		settings *classSettings
+		want     map[string]string
+	}{
+		{
+			name: "standalone pod",
+			want: map[string]string{
+				"namespace": "mynamespace",
+				"pod":       "myname",
+				"node":      "${NODENAME}",
+			},
+		},
+		{
+			name:   "pod owned by deployment",
+			owners: controllerRef("ReplicaSet", "web-5d8f7"),
+			want: map[string]string{
+				"namespace":     "mynamespace",
+				"pod":           "myname",
+				"node":          "${NODENAME}",
+				"workload_kind": "Deployment",
+				"workload_name": "web",
+			},
+		},
+		{
+			name:   "pod owned by replicaset that does not exist",
+			owners: controllerRef("ReplicaSet", "other"),
+			want: map[string]string{
+				"namespace":     "mynamespace",
+				"pod":           "myname",
+				"node":          "${NODENAME}",
+				"workload_kind": "ReplicaSet",
+				"workload_name": "other",
+			},
+		},
+		{
+			name:     "pod owned by statefulset with labels",
+			owners:   controllerRef("StatefulSet", "db"),
+			labels:   map[string]string{"app": "db", "team": "a", "other": "value"},
+			settings: &classSettings{MetadataTagsLabels: []string{"team"}},
+			want: map[string]string{
+				"namespace":     "mynamespace",
+				"pod":           "myname",
+				"node":          "${NODENAME}",
+				"workload_kind": "StatefulSet",
+				"workload_name": "db",
+				"app":           "db",
+				"team":          "a",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				Client:             testclient.NewFakeClientWithScheme(scheme, replicaSet),
+				MetadataTagsLabels: []string{"app"},
+				Logger:             testr.New(t),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "myname",
+					Namespace:       "mynamespace",
+					Labels:          tt.labels,
+					OwnerReferences: tt.owners,
+				},
+			}
+			settings := tt.settings
+			if settings == nil {
+				settings = &classSettings{}
+			}
+
+			if got := handler.metadataTags(pod, settings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadataTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_assembleConf_metadataTags(t *testing.T) {
+	tests := []struct {
+		name               string
+		enableMetadataTags bool
+		classData          string
+		wantConfig         string
+	}{
+		{
+			name: "disabled by default",
+			wantConfig: `[global_tags]
+  version = "1.0"`,
+		},
+		{
+			name:               "enabled for operator",
+			enableMetadataTags: true,
+			wantConfig: `[global_tags]
+  "app.kubernetes.io/name" = "web"
+  namespace = "mynamespace"
+  node = "${NODENAME}"
+  pod = "myname"
+  version = "1.0"`,
+		},
+		{
+			name:               "disabled for class",
+			enableMetadataTags: true,
+			classData:          "[telegraf_operator]\n  metadata_tags = false\n",
+			wantConfig: `[global_tags]
+  version = "1.0"`,
+		},
+		{
+			name:      "enabled for class",
+			classData: "[telegraf_operator]\n  metadata_tags = true\n",
+			wantConfig: `[global_tags]
+  "app.kubernetes.io/name" = "web"
+  namespace = "mynamespace"
+  node = "${NODENAME}"
+  pod = "myname"
+  version = "1.0"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				ClassDataHandler:   newMockClassDataHandler(map[string]string{"class": tt.classData}),
+				EnableMetadataTags: tt.enableMetadataTags,
+				MetadataTagsLabels: []string{"app.kubernetes.io/name"},
+				Logger:             testr.New(t),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "myname",
+					Namespace: "mynamespace",
+					Labels:    map[string]string{"app.kubernetes.io/name": "web"},
+					Annotations: map[string]string{
+						TelegrafGlobalTagLiteralPrefix + "version": "1.0",
+					},
+				},
+			}
+			gotConfig, err := handler.assembleConf(pod, "class")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.TrimSpace(gotConfig) != strings.TrimSpace(tt.wantConfig) {
+				t.Errorf("assembleConf() = %v, want %v", gotConfig, tt.wantConfig)
+			}
+		})
+	}
+}
+
+func Test_assembleConf_metadataTagsExampleClass(t *testing.T) {
+	data, err := ioutil.ReadFile("examples/classes.yml")
+	if err != nil {
+		t.Fatalf("unable to read example classes: %v", err)
+	}
+	secret := &corev1.Secret{}
+	for _, document := range strings.Split(string(data), "\n---\n") {
+		if strings.Contains(document, "kind: Secret") {
+			if err := yaml.Unmarshal([]byte(document), secret); err != nil {
+				t.Fatalf("unable to parse example classes: %v", err)
+			}
+		}
+	}
+
+	handler := &sidecarHandler{
+		ClassDataHandler:   newMockClassDataHandler(map[string]string{"app": secret.StringData["app"]}),
+		EnableMetadataTags: true,
+		Logger:             testr.New(t),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "myname",
+			Namespace: "mynamespace",
+		},
+	}
+	gotConfig, err := handler.assembleConf(pod, "app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tbl, err := toml.Parse([]byte(gotConfig))
+	if err != nil {
+		t.Fatalf("unable to parse configuration %v: %v", gotConfig, err)
+	}
+	globalTags := tbl.Fields["global_tags"].(*ast.Table)
+	// tags set by the class are kept, other metadata tags are added
+	for key, want := range map[string]string{
+		"namespace": `"$POD_NAMESPACE"`,
+		"type":      `"app"`,
+		"pod":       `"myname"`,
+		"node":      `"${NODENAME}"`,
+	} {
+		kv, ok := globalTags.Fields[key].(*ast.KeyValue)
+		if !ok {
+			t.Errorf("tag %s not found in configuration %v", key, gotConfig)
+			continue
+		}
+		if got := kv.Value.Source(); got != want {
+			t.Errorf("unexpected value %s of tag %s, want %s", got, key, want)
+		}
+	}
+}
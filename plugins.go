@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+)
+
+const (
+	inputsKind      = "inputs"
+	processorsKind  = "processors"
+	aggregatorsKind = "aggregators"
+)
+
+// validatePluginTables checks that raw TOML configuration only contains plugins of the specified kind,
+// such as "processors" or "aggregators".
+func validatePluginTables(raw, kind string) error {
+	tbl, err := toml.Parse([]byte(raw))
+	if err != nil {
+		return err
+	}
+
+	for name, field := range tbl.Fields {
+		if name != kind {
+			return fmt.Errorf("only %s are allowed, found %s", kind, name)
+		}
+
+		plugins, ok := field.(*ast.Table)
+		if !ok {
+			return fmt.Errorf("%s must be a table", kind)
+		}
+		for pluginName, plugin := range plugins.Fields {
+			switch plugin.(type) {
+			case *ast.Table, []*ast.Table:
+			default:
+				return fmt.Errorf("%s.%s must be a plugin table", kind, pluginName)
+			}
+		}
+	}
+
+	return nil
+}
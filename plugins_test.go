@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_validatePluginTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		kind    string
+		wantErr bool
+	}{
+		{
+			name: "processors",
+			raw: `[[processors.rename]]
+  [[processors.rename.replace]]
+    tag = "host"
+    dest = "hostname"
+[[processors.starlark]]
+  source = '''
+def apply(metric):
+    return metric
+'''`,
+			kind: processorsKind,
+		},
+		{
+			name: "aggregators",
+			raw: `[[aggregators.basicstats]]
+  period = "30s"
+  stats = ["mean", "max"]`,
+			kind: aggregatorsKind,
+		},
+		{
+			name: "single plugin table",
+			raw:  "[processors.rename]\n",
+			kind: processorsKind,
+		},
+		{
+			name:    "plugins of other kind",
+			raw:     "[[aggregators.basicstats]]\n[[outputs.file]]\n",
+			kind:    aggregatorsKind,
+			wantErr: true,
+		},
+		{
+			name:    "top level settings",
+			raw:     "period = \"30s\"\n[[aggregators.basicstats]]\n",
+			kind:    aggregatorsKind,
+			wantErr: true,
+		},
+		{
+			name:    "settings instead of plugins",
+			raw:     "[processors]\n  rename = true\n",
+			kind:    processorsKind,
+			wantErr: true,
+		},
+		{
+			name:    "invalid TOML",
+			raw:     "[[processors.rename]",
+			kind:    processorsKind,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePluginTables(tt.raw, tt.kind); (err != nil) != tt.wantErr {
+				t.Errorf("validatePluginTables() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_assembleConf_plugins(t *testing.T) {
+	handler := &sidecarHandler{
+		ClassDataHandler: newMockClassDataHandler(map[string]string{"class": "[[outputs.file]]\n"}),
+		Logger:           testr.New(t),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				TelegrafProcessors:  "[[processors.rename]]\n",
+				TelegrafAggregators: "[[aggregators.basicstats]]\n  period = \"30s\"\n",
+			},
+		},
+	}
+
+	got, err := handler.assembleConf(pod, "class")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[[processors.rename]]\n\n[[aggregators.basicstats]]\n  period = \"30s\"\n\n[[outputs.file]]"
+	if strings.TrimSpace(got) != want {
+		t.Errorf("assembleConf() = %q, want %q", got, want)
+	}
+
+	pod.Annotations[TelegrafProcessors] = "[[inputs.cpu]]\n"
+	if _, err := handler.assembleConf(pod, "class"); err == nil {
+		t.Errorf("expected an error for inputs in processors annotation, but none was reported")
+	}
+}
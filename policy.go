@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// policyConfig defines which telegraf sidecar settings pods are allowed to use, configured by the
+// operator administrator. Settings for a namespace are taken from Namespaces, falling back to Default.
+type policyConfig struct {
+	Default    *namespacePolicy            `json:"default,omitempty"`
+	Namespaces map[string]*namespacePolicy `json:"namespaces,omitempty"`
+}
+
+// namespacePolicy defines allow and deny lists for a single namespace. Empty allow lists allow all values,
+// deny lists always take precedence. Images, volumes and secrets are matched using patterns where "*" matches
+// any characters, so that "registry.example.com/*" allows all images from a registry.
+type namespacePolicy struct {
+	AllowedImages []string `json:"allowedImages,omitempty"`
+	DeniedImages  []string `json:"deniedImages,omitempty"`
+	AllowedInputs []string `json:"allowedInputs,omitempty"`
+	DeniedInputs  []string `json:"deniedInputs,omitempty"`
+	// AllowedProcessors, DeniedProcessors, AllowedAggregators and DeniedAggregators restrict plugins
+	// configured using the processors and aggregators annotations
+	AllowedProcessors  []string `json:"allowedProcessors,omitempty"`
+	DeniedProcessors   []string `json:"deniedProcessors,omitempty"`
+	AllowedAggregators []string `json:"allowedAggregators,omitempty"`
+	DeniedAggregators  []string `json:"deniedAggregators,omitempty"`
+	AllowedClasses     []string `json:"allowedClasses,omitempty"`
+	// AllowedVolumes lists volumes that may be mounted using the volume-mounts annotation
+	AllowedVolumes []string `json:"allowedVolumes,omitempty"`
+	// AllowedSecrets lists secrets that may be referenced using the secret-env and env-secretkeyref annotations
+	AllowedSecrets []string            `json:"allowedSecrets,omitempty"`
+	MaxRequests    corev1.ResourceList `json:"maxRequests,omitempty"`
+	MaxLimits      corev1.ResourceList `json:"maxLimits,omitempty"`
+}
+
+// loadPolicyConfig reads policy configuration from a YAML or JSON file.
+func loadPolicyConfig(filename string) (*policyConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &policyConfig{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file %s: %v", filename, err)
+	}
+
+	return p, nil
+}
+
+// forNamespace returns policy that applies to the given namespace, or nil if there are no restrictions.
+func (p *policyConfig) forNamespace(namespace string) *namespacePolicy {
+	if np, ok := p.Namespaces[namespace]; ok {
+		return np
+	}
+	return p.Default
+}
+
+// check verifies that the telegraf sidecar added to the pod is allowed by the policy,
+// returning an error describing all violations if it is not.
+func (p *policyConfig) check(namespace string, result *sidecarHandlerResponse) error {
+	np := p.forNamespace(namespace)
+	if np == nil {
+		return nil
+	}
+
+	var violations []string
+
+	// only the telegraf sidecar is checked, as the istio sidecar can not be customized by the pod
+	for i, container := range result.containers {
+		if container.Name != "telegraf" {
+			continue
+		}
+
+		if !np.imageAllowed(container.Image) {
+			violations = append(violations, fmt.Sprintf("image %q is not allowed", container.Image))
+		}
+
+		className := result.secrets[i].GetLabels()[TelegrafSecretLabelClassName]
+		if len(np.AllowedClasses) > 0 && !stringInSlice(className, np.AllowedClasses) {
+			violations = append(violations, fmt.Sprintf("class %q is not allowed", className))
+		}
+
+		violations = append(violations, checkMaxResources("requests", container.Resources.Requests, np.MaxRequests)...)
+		violations = append(violations, checkMaxResources("limits", container.Resources.Limits, np.MaxLimits)...)
+
+		for _, volume := range customVolumeNames(container, result.confs[i]) {
+			if len(np.AllowedVolumes) > 0 && !matchesAnyPattern(volume, np.AllowedVolumes) {
+				violations = append(violations, fmt.Sprintf("volume %q is not allowed", volume))
+			}
+		}
+		for _, secret := range customSecretNames(container, result.confs[i]) {
+			if len(np.AllowedSecrets) > 0 && !matchesAnyPattern(secret, np.AllowedSecrets) {
+				violations = append(violations, fmt.Sprintf("secret %q is not allowed", secret))
+			}
+		}
+
+		confViolations, err := np.checkPlugins(result.confs[i])
+		if err != nil {
+			return err
+		}
+		violations = append(violations, confViolations...)
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("telegraf sidecar violates policy for namespace %s: %s", namespace, strings.Join(violations, "; "))
+	}
+
+	return nil
+}
+
+// checkConf verifies that telegraf configuration re-rendered for an existing sidecar, such as when a ConfigMap
+// with inputs changes, is allowed by the policy. Only plugins and secrets referenced by the pod are checked,
+// as the container and its class do not change.
+func (p *policyConfig) checkConf(namespace string, conf *sidecarConf) error {
+	np := p.forNamespace(namespace)
+	if np == nil {
+		return nil
+	}
+
+	violations, err := np.checkPlugins(conf)
+	if err != nil {
+		return err
+	}
+	var secretViolations []string
+	seen := map[string]bool{}
+	for _, secret := range conf.podSecretRefs {
+		if !seen[secret] && len(np.AllowedSecrets) > 0 && !matchesAnyPattern(secret, np.AllowedSecrets) {
+			secretViolations = append(secretViolations, fmt.Sprintf("secret %q is not allowed", secret))
+		}
+		seen[secret] = true
+	}
+	// Go maps aren't ordered; we want a stable error message
+	sort.Strings(secretViolations)
+	violations = append(violations, secretViolations...)
+	if len(violations) > 0 {
+		return fmt.Errorf("telegraf configuration violates policy for namespace %s: %s", namespace, strings.Join(violations, "; "))
+	}
+
+	return nil
+}
+
+// checkPlugins returns violations of plugins used in telegraf configuration.
+func (np *namespacePolicy) checkPlugins(conf *sidecarConf) ([]string, error) {
+	var violations []string
+
+	// inputs from both the annotation and the ConfigMap are checked; any other plugins, such as outputs.exec,
+	// would allow working around restrictions of input plugins, so they are not allowed at all
+	if err := validatePluginTables(conf.rawInputs, inputsKind); err != nil {
+		return append(violations, fmt.Sprintf("invalid inputs: %v", err)), nil
+	}
+	for _, plugins := range []struct {
+		kind, name, raw string
+		allowed, denied []string
+	}{
+		{inputsKind, "input", conf.rawInputs, np.AllowedInputs, np.DeniedInputs},
+		{processorsKind, "processor", conf.rawProcessors, np.AllowedProcessors, np.DeniedProcessors},
+		{aggregatorsKind, "aggregator", conf.rawAggregators, np.AllowedAggregators, np.DeniedAggregators},
+	} {
+		names, err := pluginNames(plugins.raw, plugins.kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if stringInSlice(name, plugins.denied) || (len(plugins.allowed) > 0 && !stringInSlice(name, plugins.allowed)) {
+				violations = append(violations, fmt.Sprintf("%s plugin %q is not allowed", plugins.name, name))
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+func (np *namespacePolicy) imageAllowed(image string) bool {
+	if matchesAnyPattern(image, np.DeniedImages) {
+		return false
+	}
+	return len(np.AllowedImages) == 0 || matchesAnyPattern(image, np.AllowedImages)
+}
+
+// checkMaxResources returns violations for all resources exceeding their maximum; a resource that has
+// a maximum configured, but is not set for the container, is treated as unbounded.
+func checkMaxResources(kind string, resources, max corev1.ResourceList) []string {
+	var violations []string
+	for name, maxQuantity := range max {
+		quantity, ok := resources[name]
+		if !ok {
+			violations = append(violations, fmt.Sprintf("%s for %s must be set and may not exceed %s", kind, name, maxQuantity.String()))
+		} else if quantity.Cmp(maxQuantity) > 0 {
+			violations = append(violations, fmt.Sprintf("%s for %s of %s exceed maximum of %s", kind, name, quantity.String(), maxQuantity.String()))
+		}
+	}
+	// Go maps aren't ordered; we want a stable error message
+	sort.Strings(violations)
+	return violations
+}
+
+// customVolumeNames returns sorted names of volumes mounted in the container using the volume-mounts annotation,
+// skipping volumes that telegraf-operator mounts itself.
+func customVolumeNames(container corev1.Container, conf *sidecarConf) []string {
+	own := map[string]bool{fmt.Sprintf("%s-config", container.Name): true}
+	for _, mount := range conf.volumeMounts(container.Name) {
+		own[mount.Name] = true
+	}
+
+	var names []string
+	for _, mount := range container.VolumeMounts {
+		if !own[mount.Name] {
+			names = append(names, mount.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// customSecretNames returns sorted names of secrets referenced by the container using the secret-env and
+// env-secretkeyref annotations, skipping secrets referenced by the class.
+func customSecretNames(container corev1.Container, conf *sidecarConf) []string {
+	own := map[string]bool{}
+	for _, env := range conf.env {
+		_, podSecretRef := conf.podSecretRefs[env.Name]
+		own[env.Name] = !podSecretRef
+	}
+
+	seen := map[string]bool{}
+	for _, envFrom := range container.EnvFrom {
+		if envFrom.SecretRef != nil {
+			seen[envFrom.SecretRef.Name] = true
+		}
+	}
+	for _, env := range container.Env {
+		if !own[env.Name] && env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			seen[env.ValueFrom.SecretKeyRef.Name] = true
+		}
+	}
+
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pluginNames returns sorted names of all plugins of the specified kind, such as "inputs", defined in the raw
+// TOML configuration.
+func pluginNames(raw, kind string) ([]string, error) {
+	tbl, err := toml.Parse([]byte(raw))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", kind, err)
+	}
+
+	plugins, ok := tbl.Fields[kind].(*ast.Table)
+	if !ok {
+		return nil, nil
+	}
+
+	var names []string
+	for name := range plugins.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// matchesAnyPattern checks if value matches any of the patterns, where "*" matches any sequence of characters.
+func matchesAnyPattern(value string, patterns []string) bool {
+	for _, pattern := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if regexp.MustCompile(expr).MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_loadPolicyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "valid policy",
+			data: `
+default:
+  allowedImages: ["docker.io/library/telegraf:*"]
+namespaces:
+  team-a:
+    allowedClasses: ["app"]
+    maxLimits:
+      memory: 300Mi
+`,
+		},
+		{
+			name:    "unknown fields are rejected",
+			data:    "default:\n  allowedImage: []\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tests")
+			if err != nil {
+				t.Fatalf("unable to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			filename := filepath.Join(dir, "policy.yml")
+			if err := ioutil.WriteFile(filename, []byte(tt.data), 0600); err != nil {
+				t.Fatalf("unable to write temporary file: %v", err)
+			}
+
+			_, err = loadPolicyConfig(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadPolicyConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policyConfig_check(t *testing.T) {
+	policy := &policyConfig{
+		Default: &namespacePolicy{
+			AllowedImages: []string{"docker.io/library/telegraf:*"},
+		},
+		Namespaces: map[string]*namespacePolicy{
+			"restricted": {
+				AllowedImages:      []string{"registry.example.com/*"},
+				DeniedImages:       []string{"registry.example.com/untrusted/*"},
+				AllowedInputs:      []string{"prometheus", "redis"},
+				AllowedClasses:     []string{"default"},
+				AllowedVolumes:     []string{"shared-*"},
+				AllowedSecrets:     []string{"telegraf-*"},
+				DeniedProcessors:   []string{"execd", "starlark"},
+				AllowedAggregators: []string{"basicstats"},
+				MaxLimits: corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("100Mi"),
+				},
+			},
+			"unrestricted": {},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{
+			name:      "default policy allows default image",
+			namespace: "other",
+		},
+		{
+			name:        "default policy rejects custom image",
+			namespace:   "other",
+			annotations: map[string]string{TelegrafImage: "quay.io/telegraf:latest"},
+			wantErr:     `telegraf sidecar violates policy for namespace other: image "quay.io/telegraf:latest" is not allowed`,
+		},
+		{
+			name:        "namespace policy replaces default",
+			namespace:   "unrestricted",
+			annotations: map[string]string{TelegrafImage: "quay.io/telegraf:latest", TelegrafRawInput: "[[inputs.exec]]"},
+		},
+		{
+			name:      "all violations are reported",
+			namespace: "restricted",
+			annotations: map[string]string{
+				TelegrafImage:        "registry.example.com/untrusted/telegraf:1.22",
+				TelegrafClass:        "other",
+				TelegrafLimitsMemory: "200Mi",
+				TelegrafRawInput:     "[[inputs.redis]]\n[[inputs.exec]]\n",
+			},
+			wantErr: `telegraf sidecar violates policy for namespace restricted: image "registry.example.com/untrusted/telegraf:1.22" is not allowed; class "other" is not allowed; limits for memory of 200Mi exceed maximum of 100Mi; input plugin "exec" is not allowed`,
+		},
+		{
+			name:      "plugins other than inputs are rejected",
+			namespace: "restricted",
+			annotations: map[string]string{
+				TelegrafImage:        "registry.example.com/telegraf:1.22",
+				TelegrafLimitsMemory: "100Mi",
+				TelegrafRawInput:     "[[inputs.redis]]\n[[outputs.exec]]\n  commands = [\"sh\"]\n",
+			},
+			wantErr: `telegraf sidecar violates policy for namespace restricted: invalid inputs: only inputs are allowed, found outputs`,
+		},
+		{
+			name:      "processors and aggregators are checked",
+			namespace: "restricted",
+			annotations: map[string]string{
+				TelegrafImage:        "registry.example.com/telegraf:1.22",
+				TelegrafLimitsMemory: "100Mi",
+				TelegrafProcessors:   "[[processors.rename]]\n[[processors.execd]]\n  command = [\"sh\"]\n",
+				TelegrafAggregators:  "[[aggregators.basicstats]]\n[[aggregators.merge]]\n",
+			},
+			wantErr: `telegraf sidecar violates policy for namespace restricted: processor plugin "execd" is not allowed; aggregator plugin "merge" is not allowed`,
+		},
+		{
+			name:      "volumes and secrets from annotations are checked",
+			namespace: "restricted",
+			annotations: map[string]string{
+				TelegrafImage:                           "registry.example.com/telegraf:1.22",
+				TelegrafLimitsMemory:                    "100Mi",
+				TelegrafVolumeMounts:                    `{"shared-data": "/data", "host-root": "/host"}`,
+				TelegrafSecretEnv:                       "app-credentials",
+				TelegrafEnvSecretKeyRefPrefix + "TOKEN": "telegraf-token.token",
+				TelegrafEnvSecretKeyRefPrefix + "DB":    "db-credentials.password",
+			},
+			wantErr: `telegraf sidecar violates policy for namespace restricted: volume "host-root" is not allowed; secret "app-credentials" is not allowed; secret "db-credentials" is not allowed`,
+		},
+		{
+			name:      "secrets referenced by inputs are checked",
+			namespace: "restricted",
+			annotations: map[string]string{
+				TelegrafImage:        "registry.example.com/telegraf:1.22",
+				TelegrafLimitsMemory: "100Mi",
+				TelegrafRawInput:     "[[inputs.redis]]\n  password = \"${secretRef:db-admin/password}\"\n",
+			},
+			wantErr: `telegraf sidecar violates policy for namespace restricted: secret "db-admin" is not allowed`,
+		},
+		{
+			name:      "allowed settings pass",
+			namespace: "restricted",
+			annotations: map[string]string{
+				TelegrafImage:        "registry.example.com/telegraf:1.22",
+				TelegrafLimitsMemory: "100Mi",
+				TelegrafRawInput:     "[[inputs.redis]]\n",
+				TelegrafVolumeMounts: `{"shared-data": "/data"}`,
+				TelegrafSecretEnv:    "telegraf-credentials",
+				TelegrafProcessors:   "[[processors.rename]]\n",
+				TelegrafAggregators:  "[[aggregators.basicstats]]\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{TelegrafMetricsPort: "6060"}
+			for key, value := range tt.annotations {
+				annotations[key] = value
+			}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+
+			handler := &sidecarHandler{
+				ClassDataHandler: newMockClassDataHandler(map[string]string{
+					"default": "[[outputs.influxdb_v2]]\n  token = \"${secretRef:influxdb/token}\"\n",
+					"other":   "",
+				}),
+				TelegrafDefaultClass: "default",
+				TelegrafImage:        defaultTelegrafImage,
+				LimitsMemory:         defaultLimitsMemory,
+				Logger:               testr.New(t),
+			}
+			result, err := handler.addSidecars(pod, "myname", tt.namespace)
+			if err != nil {
+				t.Fatalf("unexpected error adding sidecar: %v", err)
+			}
+
+			err = policy.check(tt.namespace, result)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("check() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policyConfig_check_annotationInjection(t *testing.T) {
+	policy := &policyConfig{
+		Default: &namespacePolicy{AllowedInputs: []string{"prometheus"}},
+	}
+	injection := "\"]\n[[outputs.exec]]\n  commands = [\"sh\"]\n#"
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "path",
+			annotations: map[string]string{TelegrafMetricsPath: "/m" + injection},
+		},
+		{
+			name:        "scheme",
+			annotations: map[string]string{TelegrafMetricsScheme: "http" + injection},
+		},
+		{
+			name:        "interval",
+			annotations: map[string]string{TelegrafInterval: "10s" + injection},
+		},
+		{
+			name:        "namepass",
+			annotations: map[string]string{TelegrafMetricsNamepass: "['a']\n[[outputs.exec]]\n  commands = [\"sh\"]"},
+			wantErr:     true,
+		},
+		{
+			name:        "scrape host",
+			annotations: map[string]string{TelegrafScrapeHost: "127.0.0.1" + injection},
+			wantErr:     true,
+		},
+		{
+			name:        "namepass that is not an array of strings",
+			annotations: map[string]string{TelegrafMetricsNamepass: "[1, 2]"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{TelegrafMetricsPort: "6060"}
+			for key, value := range tt.annotations {
+				annotations[key] = value
+			}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+
+			handler := &sidecarHandler{
+				ClassDataHandler:     newMockClassDataHandler(map[string]string{"default": ""}),
+				TelegrafDefaultClass: "default",
+				TelegrafImage:        defaultTelegrafImage,
+				Logger:               testr.New(t),
+			}
+			result, err := handler.addSidecars(pod, "myname", "mynamespace")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, but none was reported")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error adding sidecar: %v", err)
+			}
+			if err := policy.check("mynamespace", result); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			tbl, err := toml.Parse([]byte(result.secrets[0].StringData[TelegrafSecretDataKey]))
+			if err != nil {
+				t.Fatalf("unable to parse configuration: %v", err)
+			}
+			if want, got := []string{"prometheus"}, pluginTableNames(tbl, inputsKind); !reflect.DeepEqual(want, got) {
+				t.Errorf("unexpected inputs %v, want %v", got, want)
+			}
+			if _, ok := tbl.Fields["outputs"]; ok {
+				t.Errorf("annotation added outputs to the configuration")
+			}
+		})
+	}
+}
+
+// pluginTableNames returns sorted names of plugins of the kind in the parsed configuration.
+func pluginTableNames(tbl *ast.Table, kind string) []string {
+	plugins, ok := tbl.Fields[kind].(*ast.Table)
+	if !ok {
+		return nil
+	}
+	var names []string
+	for name := range plugins.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Test_policyConfig_checkConf(t *testing.T) {
+	policy := &policyConfig{
+		Default: &namespacePolicy{
+			AllowedInputs:  []string{"redis"},
+			AllowedSecrets: []string{"telegraf-*"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		conf    *sidecarConf
+		wantErr string
+	}{
+		{
+			name: "allowed inputs and secrets",
+			conf: &sidecarConf{
+				rawInputs:     "[[inputs.redis]]\n",
+				podSecretRefs: map[string]string{"SECRET_TELEGRAF_REDIS_PASSWORD": "telegraf-redis"},
+			},
+		},
+		{
+			name: "secrets referenced by the pod are checked",
+			conf: &sidecarConf{
+				rawInputs: "[[inputs.redis]]\n",
+				podSecretRefs: map[string]string{
+					"SECRET_DB_ADMIN_PASSWORD": "db-admin",
+					"SECRET_DB_ADMIN_USER":     "db-admin",
+				},
+			},
+			wantErr: `telegraf configuration violates policy for namespace ns1: secret "db-admin" is not allowed`,
+		},
+		{
+			name:    "inputs are checked",
+			conf:    &sidecarConf{rawInputs: "[[inputs.exec]]\n"},
+			wantErr: `telegraf configuration violates policy for namespace ns1: input plugin "exec" is not allowed`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.checkConf("ns1", tt.conf)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("checkConf() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// procstatCapability is the capability the sidecar needs to read details, such as open file descriptors,
+// of processes of other containers running as different users
+const procstatCapability corev1.Capability = "SYS_PTRACE"
+
+// parseProcstatSettings parses patterns of processes to monitor in application containers from the pod's annotation,
+// by container name; nil is returned if process monitoring is not enabled for the pod. As monitoring processes of
+// other containers requires sharing the process namespace, an error is returned if the pod does not allow it.
+func parseProcstatSettings(pod *corev1.Pod) (map[string]string, error) {
+	procstatRaw, ok := pod.Annotations[TelegrafProcstat]
+	if !ok {
+		return nil, nil
+	}
+
+	patterns := map[string]string{}
+	if err := json.Unmarshal([]byte(procstatRaw), &patterns); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", TelegrafProcstat, err)
+	}
+
+	for containerName, pattern := range patterns {
+		if !podHasContainerName(pod, containerName) {
+			return nil, fmt.Errorf("invalid %s annotation: container %s not found in the pod", TelegrafProcstat, containerName)
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("invalid %s annotation: pattern for container %s must be specified", TelegrafProcstat, containerName)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: invalid pattern for container %s: %v", TelegrafProcstat, containerName, err)
+		}
+	}
+
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	if pod.Spec.HostPID {
+		return nil, fmt.Errorf("%s annotation can not be used for pods using the host's process namespace", TelegrafProcstat)
+	}
+	if pod.Spec.ShareProcessNamespace != nil && !*pod.Spec.ShareProcessNamespace {
+		return nil, fmt.Errorf("%s annotation can not be used for pods that disable sharing the process namespace", TelegrafProcstat)
+	}
+
+	return patterns, nil
+}
+
+// procstatInputs returns [[inputs.procstat]] configuration monitoring processes matching the pattern for each
+// application container, tagged with the name of the container.
+func procstatInputs(patterns map[string]string) string {
+	containerNames := make([]string, 0, len(patterns))
+	for containerName := range patterns {
+		containerNames = append(containerNames, containerName)
+	}
+	sort.Strings(containerNames)
+
+	inputs := ""
+	for _, containerName := range containerNames {
+		// the native finder is used, as it does not depend on pgrep being available in the telegraf image
+		inputs = fmt.Sprintf("%s[[inputs.procstat]]\n  pattern = %s\n  pid_finder = \"native\"\n  [inputs.procstat.tags]\n    container_name = %s\n",
+			inputs, tomlString(patterns[containerName]), tomlString(containerName))
+	}
+
+	return inputs
+}
+
+// shareProcessNamespace enables sharing the process namespace between containers of the pod.
+func shareProcessNamespace(pod *corev1.Pod) {
+	share := true
+	pod.Spec.ShareProcessNamespace = &share
+}
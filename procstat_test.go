@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/toml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseProcstatSettings(t *testing.T) {
+	share := true
+	noShare := false
+
+	tests := []struct {
+		name     string
+		procstat string
+		spec     corev1.PodSpec
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name:     "pattern for container",
+			procstat: `{"app": "java .*server.jar"}`,
+			want:     map[string]string{"app": "java .*server.jar"},
+		},
+		{
+			name:     "sharing process namespace already enabled",
+			procstat: `{"app": "nginx"}`,
+			spec:     corev1.PodSpec{ShareProcessNamespace: &share},
+			want:     map[string]string{"app": "nginx"},
+		},
+		{
+			name:     "empty list of containers",
+			procstat: `{}`,
+		},
+		{
+			name:     "invalid JSON",
+			procstat: `["app"]`,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown container",
+			procstat: `{"other": "nginx"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "empty pattern",
+			procstat: `{"app": ""}`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid pattern",
+			procstat: `{"app": "java ("}`,
+			wantErr:  true,
+		},
+		{
+			name:     "sharing process namespace disabled",
+			procstat: `{"app": "nginx"}`,
+			spec:     corev1.PodSpec{ShareProcessNamespace: &noShare},
+			wantErr:  true,
+		},
+		{
+			name:     "host process namespace",
+			procstat: `{"app": "nginx"}`,
+			spec:     corev1.PodSpec{HostPID: true},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+				Spec:       tt.spec,
+			}
+			pod.Spec.Containers = []corev1.Container{{Name: "app"}}
+			if tt.procstat != "" {
+				pod.Annotations[TelegrafProcstat] = tt.procstat
+			}
+
+			got, err := parseProcstatSettings(pod)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseProcstatSettings() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProcstatSettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_procstatInputs(t *testing.T) {
+	got := procstatInputs(map[string]string{
+		"nginx": "nginx: master",
+		"app":   `java .*\.jar`,
+	})
+	want := `[[inputs.procstat]]
+  pattern = "java .*\\.jar"
+  pid_finder = "native"
+  [inputs.procstat.tags]
+    container_name = "app"
+[[inputs.procstat]]
+  pattern = "nginx: master"
+  pid_finder = "native"
+  [inputs.procstat.tags]
+    container_name = "nginx"
+`
+	if got != want {
+		t.Errorf("procstatInputs() = %v, want %v", got, want)
+	}
+	if _, err := toml.Parse([]byte(got)); err != nil {
+		t.Errorf("procstatInputs() returned invalid TOML: %v", err)
+	}
+}
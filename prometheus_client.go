@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// prometheusClientPortName is the name of the sidecar's container port exposing metrics for prometheus;
+	// it does not match the default scrape discovery port names, so that the sidecar does not scrape itself
+	prometheusClientPortName = "telegraf-prom"
+
+	defaultPrometheusClientPort = 9273
+	defaultPrometheusClientPath = "/metrics"
+
+	// TelegrafOriginalPrometheusAnnotations is set by telegraf-operator to record prometheus.io annotations of the pod,
+	// as JSON, before they were replaced with ones pointing to the sidecar; scrape discovery uses the original ones
+	TelegrafOriginalPrometheusAnnotations = "telegraf.influxdata.com/original-prometheus-annotations"
+)
+
+// prometheusAnnotations lists prometheus.io annotations that are replaced when exposing metrics for prometheus.
+var prometheusAnnotations = []string{
+	PrometheusScrapeAnnotation,
+	PrometheusPortAnnotation,
+	PrometheusPathAnnotation,
+	PrometheusSchemeAnnotation,
+}
+
+// prometheusClientSettings describes how the sidecar exposes metrics for prometheus to scrape.
+type prometheusClientSettings struct {
+	// Port is the port that metrics are exposed on, defaults to 9273
+	Port int `toml:"port"`
+	// Path is the HTTP path that metrics are exposed on, defaults to /metrics
+	Path string `toml:"path"`
+}
+
+// prometheusClient returns settings of exposing metrics for prometheus with defaults applied; nil is returned if
+// the class does not enable it. An error is returned if the port is already used by a listener or by one of the
+// pod's containers.
+func prometheusClient(pod *corev1.Pod, settings *classSettings, listeners []listener) (*prometheusClientSettings, error) {
+	if settings.PrometheusClient == nil {
+		return nil, nil
+	}
+
+	result := *settings.PrometheusClient
+	if result.Port == 0 {
+		result.Port = defaultPrometheusClientPort
+	}
+	if result.Path == "" {
+		result.Path = defaultPrometheusClientPath
+	}
+	if result.Port < 1 || result.Port > 65535 {
+		return nil, fmt.Errorf("prometheus client port %d is out of range", result.Port)
+	}
+	if !strings.HasPrefix(result.Path, "/") {
+		return nil, fmt.Errorf("prometheus client path must start with /, %q given", result.Path)
+	}
+
+	port := int32(result.Port)
+	for _, l := range listeners {
+		if l.port == port && l.protocol == corev1.ProtocolTCP {
+			return nil, fmt.Errorf("prometheus client port %d is already used by listener %s", port, l.name)
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		if isSidecarContainerName(container.Name) {
+			continue
+		}
+		for _, containerPort := range container.Ports {
+			if containerPort.ContainerPort == port && protocolOrDefault(containerPort.Protocol) == corev1.ProtocolTCP {
+				return nil, fmt.Errorf("prometheus client port %d is already used by container %s", port, container.Name)
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// outputConf returns configuration of the output exposing metrics for prometheus.
+func (s *prometheusClientSettings) outputConf() string {
+	return fmt.Sprintf("[[outputs.prometheus_client]]\n  listen = \":%d\"\n  path = %s\n", s.Port, tomlString(s.Path))
+}
+
+// checkScrapedPort returns an error if the prometheus.io annotations of the pod point at a port that telegraf
+// does not scrape, as replacing them to expose metrics of the sidecar would stop prometheus from scraping it.
+func (s *prometheusClientSettings) checkScrapedPort(pod *corev1.Pod, scrapedPorts []string) error {
+	if s == nil {
+		return nil
+	}
+
+	annotations := originalPrometheusAnnotations(pod)
+	port, ok := annotations[PrometheusPortAnnotation]
+	if annotations[PrometheusScrapeAnnotation] != "true" || !ok {
+		return nil
+	}
+
+	resolved, err := resolvePort(pod, port)
+	if err == nil && stringInSlice(resolved, scrapedPorts) {
+		return nil
+	}
+	return fmt.Errorf("%s annotation points at port %s that is not scraped by telegraf, so exposing metrics of the sidecar for prometheus would stop prometheus from scraping it; scrape the port using the %s annotation or set %s to false", PrometheusPortAnnotation, port, TelegrafMetricsPort, PrometheusScrapeAnnotation)
+}
+
+// addPrometheusAnnotations points prometheus.io annotations of the pod to metrics exposed by the sidecar,
+// recording the original annotations so that they are still used for scrape discovery. Annotations of pods
+// that have prometheus.io/scrape set to false are not changed.
+func addPrometheusAnnotations(pod *corev1.Pod, settings *prometheusClientSettings) error {
+	if settings == nil || originalPrometheusAnnotations(pod)[PrometheusScrapeAnnotation] == "false" {
+		return nil
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+
+	if _, ok := pod.Annotations[TelegrafOriginalPrometheusAnnotations]; !ok {
+		original := map[string]string{}
+		for _, key := range prometheusAnnotations {
+			if value, ok := pod.Annotations[key]; ok {
+				original[key] = value
+			}
+		}
+		data, err := json.Marshal(original)
+		if err != nil {
+			return err
+		}
+		pod.Annotations[TelegrafOriginalPrometheusAnnotations] = string(data)
+	}
+
+	pod.Annotations[PrometheusScrapeAnnotation] = "true"
+	pod.Annotations[PrometheusPortAnnotation] = strconv.Itoa(settings.Port)
+	pod.Annotations[PrometheusPathAnnotation] = settings.Path
+	pod.Annotations[PrometheusSchemeAnnotation] = "http"
+
+	return nil
+}
+
+// originalPrometheusAnnotations returns prometheus.io annotations of the pod before they were replaced by
+// telegraf-operator; annotations are returned as is if they were not replaced.
+func originalPrometheusAnnotations(pod *corev1.Pod) map[string]string {
+	originalRaw, ok := pod.Annotations[TelegrafOriginalPrometheusAnnotations]
+	if !ok {
+		return pod.Annotations
+	}
+
+	original := map[string]string{}
+	if err := json.Unmarshal([]byte(originalRaw), &original); err != nil {
+		// the annotation is set by telegraf-operator, so this only happens if it was modified
+		return map[string]string{}
+	}
+	return original
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_prometheusClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		settings   *classSettings
+		listeners  string
+		containers []corev1.Container
+		want       *prometheusClientSettings
+		wantErr    bool
+	}{
+		{
+			name:     "disabled by default",
+			settings: &classSettings{},
+		},
+		{
+			name:     "defaults",
+			settings: &classSettings{PrometheusClient: &prometheusClientSettings{}},
+			want:     &prometheusClientSettings{Port: 9273, Path: "/metrics"},
+		},
+		{
+			name:     "custom port and path",
+			settings: &classSettings{PrometheusClient: &prometheusClientSettings{Port: 9100, Path: "/telegraf"}},
+			want:     &prometheusClientSettings{Port: 9100, Path: "/telegraf"},
+		},
+		{
+			name:      "same port as UDP listener",
+			settings:  &classSettings{PrometheusClient: &prometheusClientSettings{Port: 8125}},
+			listeners: "statsd",
+			want:      &prometheusClientSettings{Port: 8125, Path: "/metrics"},
+		},
+		{
+			name:     "port out of range",
+			settings: &classSettings{PrometheusClient: &prometheusClientSettings{Port: 70000}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid path",
+			settings: &classSettings{PrometheusClient: &prometheusClientSettings{Path: "metrics"}},
+			wantErr:  true,
+		},
+		{
+			name:      "port used by listener",
+			settings:  &classSettings{PrometheusClient: &prometheusClientSettings{Port: 8186}},
+			listeners: "influxdb_listener",
+			wantErr:   true,
+		},
+		{
+			name:     "port used by container",
+			settings: &classSettings{PrometheusClient: &prometheusClientSettings{}},
+			containers: []corev1.Container{
+				{Name: "app", Ports: []corev1.ContainerPort{{ContainerPort: 9273}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+				Spec:       corev1.PodSpec{Containers: tt.containers},
+			}
+			if tt.listeners != "" {
+				pod.Annotations[TelegrafListeners] = tt.listeners
+			}
+			listeners, err := parseListeners(pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := prometheusClient(pod, tt.settings, listeners)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("prometheusClient() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prometheusClient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_assembleConf_prometheusClient(t *testing.T) {
+	handler := &sidecarHandler{
+		ClassDataHandler: newMockClassDataHandler(map[string]string{
+			"default": `[telegraf_operator.prometheus_client]
+  port = 9100
+`,
+		}),
+		TelegrafDefaultClass:     "default",
+		TelegrafImage:            defaultTelegrafImage,
+		EnableScrapeDiscovery:    true,
+		ScrapeDiscoveryPortNames: []string{"metrics", "*-prom"},
+		ScrapeHost:               "127.0.0.1",
+		Logger:                   testr.New(t),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				PrometheusScrapeAnnotation: "true",
+				PrometheusPortAnnotation:   "8080",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}},
+		},
+	}
+
+	result, err := handler.addSidecars(pod, "myname", "mynamespace")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	telegrafConf := result.secrets[0].StringData[TelegrafSecretDataKey]
+
+	// re-rendering the configuration for the pod, as the secrets updater does, still scrapes the application
+	pod.Namespace = "mynamespace"
+	got, err := handler.assembleConf(pod, "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != telegrafConf {
+		t.Errorf("re-rendered configuration %v differs from %v", got, telegrafConf)
+	}
+}
+
+func Test_addSidecars_prometheusClient_originalAnnotations(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		wantAnnotations map[string]string
+		wantErr         string
+	}{
+		{
+			name:        "pods without prometheus annotations are annotated",
+			annotations: map[string]string{TelegrafClass: "default"},
+			wantAnnotations: map[string]string{
+				TelegrafClass:                         "default",
+				PrometheusScrapeAnnotation:            "true",
+				PrometheusPortAnnotation:              "9100",
+				PrometheusPathAnnotation:              "/metrics",
+				PrometheusSchemeAnnotation:            "http",
+				TelegrafOriginalPrometheusAnnotations: `{}`,
+			},
+		},
+		{
+			name: "pods with scrape set to false are not annotated",
+			annotations: map[string]string{
+				TelegrafClass:              "default",
+				PrometheusScrapeAnnotation: "false",
+				PrometheusPortAnnotation:   "8080",
+			},
+			wantAnnotations: map[string]string{
+				TelegrafClass:              "default",
+				PrometheusScrapeAnnotation: "false",
+				PrometheusPortAnnotation:   "8080",
+			},
+		},
+		{
+			name: "port scraped by telegraf",
+			annotations: map[string]string{
+				TelegrafMetricsPort:        "8080",
+				PrometheusScrapeAnnotation: "true",
+				PrometheusPortAnnotation:   "http",
+			},
+			wantAnnotations: map[string]string{
+				TelegrafMetricsPort:                   "8080",
+				PrometheusScrapeAnnotation:            "true",
+				PrometheusPortAnnotation:              "9100",
+				PrometheusPathAnnotation:              "/metrics",
+				PrometheusSchemeAnnotation:            "http",
+				TelegrafOriginalPrometheusAnnotations: `{"prometheus.io/port":"http","prometheus.io/scrape":"true"}`,
+			},
+		},
+		{
+			name: "port not scraped by telegraf",
+			annotations: map[string]string{
+				TelegrafClass:              "default",
+				PrometheusScrapeAnnotation: "true",
+				PrometheusPortAnnotation:   "8080",
+			},
+			wantErr: "prometheus.io/port annotation points at port 8080 that is not scraped by telegraf, so exposing metrics of the sidecar for prometheus would stop prometheus from scraping it; scrape the port using the telegraf.influxdata.com/port annotation or set prometheus.io/scrape to false",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				ClassDataHandler: newMockClassDataHandler(map[string]string{
+					"default": "[telegraf_operator.prometheus_client]\n  port = 9100\n",
+				}),
+				TelegrafDefaultClass: "default",
+				TelegrafImage:        defaultTelegrafImage,
+				Logger:               testr.New(t),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "app",
+						Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+					}},
+				},
+			}
+
+			_, err := handler.addSidecars(pod, "myname", "mynamespace")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("unexpected error %v, want %v", err, tt.wantErr)
+				}
+				if _, ok := err.(*nonFatalError); ok {
+					t.Errorf("unscraped port must not be a non-fatal error, so that the pod is rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(pod.Annotations, tt.wantAnnotations) {
+				t.Errorf("unexpected annotations %v, want %v", pod.Annotations, tt.wantAnnotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// resourcesProfile is a named set of resources and agent buffer settings of the telegraf sidecar, configured
+// by the operator administrator, that pods can select instead of specifying resources themselves.
+type resourcesProfile struct {
+	Requests corev1.ResourceList `json:"requests,omitempty"`
+	Limits   corev1.ResourceList `json:"limits,omitempty"`
+	// MetricBufferLimit and MetricBatchSize set the metric_buffer_limit and metric_batch_size agent settings
+	MetricBufferLimit int `json:"metricBufferLimit,omitempty"`
+	MetricBatchSize   int `json:"metricBatchSize,omitempty"`
+}
+
+// loadResourcesProfiles reads resources profiles, by name, from a YAML or JSON file.
+func loadResourcesProfiles(filename string) (map[string]*resourcesProfile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := map[string]*resourcesProfile{}
+	if err := yaml.UnmarshalStrict(data, &profiles); err != nil {
+		return nil, fmt.Errorf("unable to parse resources profiles file %s: %v", filename, err)
+	}
+
+	for name, profile := range profiles {
+		if err := profile.validate(); err != nil {
+			return nil, fmt.Errorf("invalid resources profile %s: %v", name, err)
+		}
+	}
+
+	return profiles, nil
+}
+
+// validate checks that only CPU and memory are specified, that requests do not exceed limits and that
+// agent settings are not negative.
+func (p *resourcesProfile) validate() error {
+	if p == nil {
+		return fmt.Errorf("profile must not be empty")
+	}
+	for _, resources := range []corev1.ResourceList{p.Requests, p.Limits} {
+		for name := range resources {
+			if name != corev1.ResourceCPU && name != corev1.ResourceMemory {
+				return fmt.Errorf("unsupported resource %s, only cpu and memory are supported", name)
+			}
+		}
+	}
+	for name, request := range p.Requests {
+		if limit, ok := p.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("requests for %s of %s exceed limits of %s", name, request.String(), limit.String())
+		}
+	}
+	if p.MetricBufferLimit < 0 || p.MetricBatchSize < 0 {
+		return fmt.Errorf("metricBufferLimit and metricBatchSize must not be negative")
+	}
+	return nil
+}
+
+// resourcesProfile returns the resources profile selected by the pod, or nil if the pod does not select one;
+// an error is returned if the profile is not known.
+func (h *sidecarHandler) resourcesProfile(pod *corev1.Pod) (*resourcesProfile, error) {
+	name, ok := pod.Annotations[TelegrafResourcesProfile]
+	if !ok {
+		return nil, nil
+	}
+
+	profile, ok := h.ResourcesProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(h.ResourcesProfiles))
+		for name := range h.ResourcesProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unknown resources profile %q in %s annotation, no profiles are configured", name, TelegrafResourcesProfile)
+		}
+		return nil, fmt.Errorf("unknown resources profile %q in %s annotation, expected one of: %s", name, TelegrafResourcesProfile, strings.Join(names, ", "))
+	}
+
+	return profile, nil
+}
+
+// agentConf returns [agent] settings of the profile, or an empty string if it has none.
+func (p *resourcesProfile) agentConf() string {
+	conf := ""
+	if p.MetricBufferLimit > 0 {
+		conf = fmt.Sprintf("%smetric_buffer_limit = %d\n", conf, p.MetricBufferLimit)
+	}
+	if p.MetricBatchSize > 0 {
+		conf = fmt.Sprintf("%smetric_batch_size = %d\n", conf, p.MetricBatchSize)
+	}
+	return conf
+}
+
+// applyTo returns container settings with resources of the profile taking precedence over the given ones.
+func (p *resourcesProfile) applyTo(settings containerSettings) containerSettings {
+	for _, resource := range []struct {
+		resources corev1.ResourceList
+		name      corev1.ResourceName
+		value     *string
+	}{
+		{p.Requests, corev1.ResourceCPU, &settings.RequestsCPU},
+		{p.Requests, corev1.ResourceMemory, &settings.RequestsMemory},
+		{p.Limits, corev1.ResourceCPU, &settings.LimitsCPU},
+		{p.Limits, corev1.ResourceMemory, &settings.LimitsMemory},
+	} {
+		if quantity, ok := resource.resources[resource.name]; ok {
+			*resource.value = quantity.String()
+		}
+	}
+	return settings
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_loadResourcesProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "valid profiles",
+			data: `
+small:
+  requests:
+    cpu: 10m
+    memory: 32Mi
+  limits:
+    memory: 64Mi
+scraper-heavy:
+  limits:
+    cpu: "1"
+    memory: 512Mi
+  metricBufferLimit: 100000
+  metricBatchSize: 5000
+`,
+		},
+		{
+			name:    "unknown fields are rejected",
+			data:    "small:\n  request:\n    cpu: 10m\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid quantity",
+			data:    "small:\n  requests:\n    cpu: 10 cores\n",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported resource",
+			data:    "small:\n  limits:\n    ephemeral-storage: 1Gi\n",
+			wantErr: true,
+		},
+		{
+			name:    "requests exceed limits",
+			data:    "small:\n  requests:\n    memory: 128Mi\n  limits:\n    memory: 64Mi\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative buffer limit",
+			data:    "small:\n  metricBufferLimit: -1\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty profile",
+			data:    "small:\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tests")
+			if err != nil {
+				t.Fatalf("unable to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			filename := filepath.Join(dir, "profiles.yml")
+			if err := ioutil.WriteFile(filename, []byte(tt.data), 0600); err != nil {
+				t.Fatalf("unable to write temporary file: %v", err)
+			}
+
+			_, err = loadResourcesProfiles(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadResourcesProfiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PrometheusScrapeAnnotation is the de-facto standard annotation to enable or disable prometheus scraping of a pod
+	PrometheusScrapeAnnotation = "prometheus.io/scrape"
+	// PrometheusPortAnnotation is the de-facto standard annotation specifying port to scrape
+	PrometheusPortAnnotation = "prometheus.io/port"
+	// PrometheusPathAnnotation is the de-facto standard annotation specifying path to scrape
+	PrometheusPathAnnotation = "prometheus.io/path"
+	// PrometheusSchemeAnnotation is the de-facto standard annotation specifying scheme to scrape
+	PrometheusSchemeAnnotation = "prometheus.io/scheme"
+)
+
+// scrapeTarget describes a single prometheus endpoint to scrape, as specified in TelegrafScrapeTargets annotation.
+type scrapeTarget struct {
+	Port               intstr.IntOrString `json:"port"`
+	Path               string             `json:"path,omitempty"`
+	Scheme             string             `json:"scheme,omitempty"`
+	Interval           string             `json:"interval,omitempty"`
+	Namepass           []string           `json:"namepass,omitempty"`
+	TLSCA              string             `json:"tlsCA,omitempty"`
+	TLSCert            string             `json:"tlsCert,omitempty"`
+	TLSKey             string             `json:"tlsKey,omitempty"`
+	InsecureSkipVerify bool               `json:"insecureSkipVerify,omitempty"`
+	BearerToken        string             `json:"bearerToken,omitempty"`
+	BearerTokenString  string             `json:"bearerTokenString,omitempty"`
+}
+
+// scrapeTargets parses the TelegrafScrapeTargets annotation, which may be either JSON or YAML formatted,
+// applying defaults and validating all of the targets.
+func scrapeTargets(pod *corev1.Pod) ([]scrapeTarget, error) {
+	raw, ok := pod.Annotations[TelegrafScrapeTargets]
+	if !ok {
+		return nil, nil
+	}
+
+	var targets []scrapeTarget
+	if err := yaml.UnmarshalStrict([]byte(raw), &targets); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", TelegrafScrapeTargets, err)
+	}
+
+	for i := range targets {
+		target := &targets[i]
+		if target.Port.String() == "" || target.Port.String() == "0" {
+			return nil, fmt.Errorf("%s: port must be specified for target %d", TelegrafScrapeTargets, i)
+		}
+		if target.Path == "" {
+			target.Path = "/metrics"
+		}
+		if !isAbsolutePath(target.Path) {
+			return nil, fmt.Errorf("%s: path for target %d must be an absolute path, %q given", TelegrafScrapeTargets, i, target.Path)
+		}
+		if target.Scheme == "" {
+			target.Scheme = "http"
+		}
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return nil, fmt.Errorf("%s: scheme for target %d must be http or https, %s given", TelegrafScrapeTargets, i, target.Scheme)
+		}
+		if target.Interval != "" {
+			if _, err := time.ParseDuration(target.Interval); err != nil {
+				return nil, fmt.Errorf("%s: invalid interval for target %d: %v", TelegrafScrapeTargets, i, err)
+			}
+		}
+		if target.BearerToken != "" && target.BearerTokenString != "" {
+			return nil, fmt.Errorf("%s: only one of bearerToken and bearerTokenString can be specified for target %d", TelegrafScrapeTargets, i)
+		}
+	}
+
+	return targets, nil
+}
+
+// discoverScrapeTargets finds endpoints to scrape based on prometheus.io annotations and, if the pod does not
+// specify the port using the annotations, container ports whose names match ScrapeDiscoveryPortNames.
+// Pods that have prometheus.io/scrape set to false are never scraped. If telegraf-operator replaced the prometheus.io
+// annotations to expose metrics of the sidecar, the original annotations are used, and ports of the sidecars are
+// never discovered, so that the sidecar does not scrape itself. An error is returned if prometheus.io/path is not
+// an absolute path.
+func (h *sidecarHandler) discoverScrapeTargets(pod *corev1.Pod) ([]scrapeTarget, error) {
+	annotations := originalPrometheusAnnotations(pod)
+	if !h.EnableScrapeDiscovery || annotations[PrometheusScrapeAnnotation] == "false" {
+		return nil, nil
+	}
+
+	path := annotations[PrometheusPathAnnotation]
+	if path == "" {
+		path = "/metrics"
+	}
+	if !isAbsolutePath(path) {
+		return nil, fmt.Errorf("%s annotation must be an absolute path, %q given", PrometheusPathAnnotation, path)
+	}
+	scheme := annotations[PrometheusSchemeAnnotation]
+	if scheme != "https" {
+		scheme = "http"
+	}
+
+	if annotations[PrometheusScrapeAnnotation] == "true" {
+		if port, ok := annotations[PrometheusPortAnnotation]; ok {
+			return []scrapeTarget{{Port: intstr.Parse(port), Path: path, Scheme: scheme}}, nil
+		}
+	}
+
+	var targets []scrapeTarget
+	for _, container := range pod.Spec.Containers {
+		if isSidecarContainerName(container.Name) {
+			continue
+		}
+		for _, port := range container.Ports {
+			if port.Name != "" && matchesAnyPattern(port.Name, h.ScrapeDiscoveryPortNames) {
+				targets = append(targets, scrapeTarget{Port: intstr.FromInt(int(port.ContainerPort)), Path: path, Scheme: scheme})
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// isAbsolutePath checks that path can be appended to host and port of a URL.
+func isAbsolutePath(path string) bool {
+	_, err := url.ParseRequestURI(path)
+	return err == nil && strings.HasPrefix(path, "/")
+}
+
+// inputConf renders telegraf configuration scraping the target on the specified host.
+func (t *scrapeTarget) inputConf(host string) string {
+	targetURL := fmt.Sprintf("%s://%s:%s%s", t.Scheme, host, t.Port.String(), t.Path)
+	conf := fmt.Sprintf("\n[[inputs.prometheus]]\n  urls = [%s]\n", tomlString(targetURL))
+
+	if t.Interval != "" {
+		conf = fmt.Sprintf("%s  interval = %s\n", conf, tomlString(t.Interval))
+	}
+	if len(t.Namepass) > 0 {
+		conf = fmt.Sprintf("%s  namepass = %s\n", conf, tomlStringArray(t.Namepass))
+	}
+	for _, kv := range []struct{ key, value string }{
+		{"tls_ca", t.TLSCA},
+		{"tls_cert", t.TLSCert},
+		{"tls_key", t.TLSKey},
+		{"bearer_token", t.BearerToken},
+		{"bearer_token_string", t.BearerTokenString},
+	} {
+		if kv.value != "" {
+			conf = fmt.Sprintf("%s  %s = %s\n", conf, kv.key, tomlString(kv.value))
+		}
+	}
+	if t.InsecureSkipVerify {
+		conf = fmt.Sprintf("%s  insecure_skip_verify = true\n", conf)
+	}
+
+	return conf
+}
+
+// tomlStringArray renders a list of strings as TOML array.
+func tomlStringArray(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, tomlString(value))
+	}
+	return fmt.Sprintf("[%s]", strings.Join(quoted, ", "))
+}
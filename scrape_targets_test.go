@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_scrapeTargets(t *testing.T) {
+	tests := []struct {
+		name       string
+		targets    string
+		wantConfig string
+		wantErr    bool
+	}{
+		{
+			name:    "JSON targets with defaults",
+			targets: `[{"port": 8080}, {"port": "9443", "path": "/admin/metrics", "scheme": "https"}]`,
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:8080/metrics"]
+
+[[inputs.prometheus]]
+  urls = ["https://127.0.0.1:9443/admin/metrics"]
+`,
+		},
+		{
+			name: "YAML target with all settings",
+			targets: `
+- port: 9443
+  path: /admin/metrics
+  scheme: https
+  interval: 30s
+  namepass: ["http_*", "go_*"]
+  tlsCA: /etc/telegraf-tls/ca.crt
+  insecureSkipVerify: true
+  bearerToken: /var/run/secrets/kubernetes.io/serviceaccount/token
+`,
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["https://127.0.0.1:9443/admin/metrics"]
+  interval = "30s"
+  namepass = ["http_*", "go_*"]
+  tls_ca = "/etc/telegraf-tls/ca.crt"
+  bearer_token = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+  insecure_skip_verify = true
+`,
+		},
+		{
+			name:    "values are escaped",
+			targets: `[{"port": 8080, "path": "/metrics?name=\"up\"", "namepass": ["up\""], "bearerTokenString": "a\\b"}]`,
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:8080/metrics?name=\"up\""]
+  namepass = ["up\""]
+  bearer_token_string = "a\\b"
+`,
+		},
+		{
+			name:    "relative path",
+			targets: `[{"port": 8080, "path": "metrics"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid path",
+			targets: `[{"port": 8080, "path": "/metrics\n"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing port",
+			targets: `[{"path": "/metrics"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid scheme",
+			targets: `[{"port": 8080, "scheme": "ftp"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid interval",
+			targets: `[{"port": 8080, "interval": "often"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			targets: `[{"port": 8080, "url": "http://localhost"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "both bearer token settings",
+			targets: `[{"port": 8080, "bearerToken": "/token", "bearerTokenString": "secret"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafScrapeTargets: tt.targets,
+					},
+				},
+			}
+			targets, err := scrapeTargets(pod)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("scrapeTargets() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			gotConfig := ""
+			for _, target := range targets {
+				gotConfig += target.inputConf("127.0.0.1")
+			}
+			if strings.TrimSpace(gotConfig) != strings.TrimSpace(tt.wantConfig) {
+				t.Errorf("inputConf() = %v, want %v", gotConfig, tt.wantConfig)
+			}
+		})
+	}
+}
+
+func Test_discoverScrapeTargets(t *testing.T) {
+	containers := []corev1.Container{
+		{
+			Name: "app",
+			Ports: []corev1.ContainerPort{
+				{Name: "http", ContainerPort: 8080},
+				{Name: "metrics", ContainerPort: 9090},
+			},
+		},
+		{
+			Name: "proxy",
+			Ports: []corev1.ContainerPort{
+				{Name: "proxy-metrics", ContainerPort: 9091},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		disabled    bool
+		annotations map[string]string
+		wantConfig  string
+		wantErr     bool
+	}{
+		{
+			name:     "discovery disabled",
+			disabled: true,
+			annotations: map[string]string{
+				PrometheusScrapeAnnotation: "true",
+				PrometheusPortAnnotation:   "8080",
+			},
+		},
+		{
+			name: "prometheus annotations",
+			annotations: map[string]string{
+				PrometheusScrapeAnnotation: "true",
+				PrometheusPortAnnotation:   "8080",
+				PrometheusPathAnnotation:   "/stats",
+				PrometheusSchemeAnnotation: "https",
+			},
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["https://127.0.0.1:8080/stats"]
+`,
+		},
+		{
+			name: "named container ports",
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:9090/metrics"]
+
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:9091/metrics"]
+`,
+		},
+		{
+			name: "scraping disabled by annotation",
+			annotations: map[string]string{
+				PrometheusScrapeAnnotation: "false",
+			},
+		},
+		{
+			name: "relative path",
+			annotations: map[string]string{
+				PrometheusScrapeAnnotation: "true",
+				PrometheusPortAnnotation:   "8080",
+				PrometheusPathAnnotation:   "metrics",
+			},
+			wantErr: true,
+		},
+		{
+			name: "relative path for named container ports",
+			annotations: map[string]string{
+				PrometheusPathAnnotation: "metrics",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				EnableScrapeDiscovery:    !tt.disabled,
+				ScrapeDiscoveryPortNames: []string{"metrics", "*-metrics"},
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec:       corev1.PodSpec{Containers: containers},
+			}
+
+			targets, err := handler.discoverScrapeTargets(pod)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("discoverScrapeTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			gotConfig := ""
+			for _, target := range targets {
+				gotConfig += target.inputConf("127.0.0.1")
+			}
+			if strings.TrimSpace(gotConfig) != strings.TrimSpace(tt.wantConfig) {
+				t.Errorf("discoverScrapeTargets() = %v, want %v", gotConfig, tt.wantConfig)
+			}
+			if got, want := handler.shouldAddTelegrafSidecar(pod), tt.wantConfig != "" || tt.wantErr; got != want {
+				t.Errorf("shouldAddTelegrafSidecar() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// secretRefPrefix is the prefix of secret references in class data, such as "${secretRef:influxdb/token}"
+	secretRefPrefix = "${secretRef:"
+	// secretRefEnvPrefix is the prefix of environment variables that secret references are replaced with
+	secretRefEnvPrefix = "SECRET_"
+)
+
+var (
+	// secretRefRegexp matches secret references, capturing name of the secret and the key in the secret
+	secretRefRegexp = regexp.MustCompile(`\$\{secretRef:([a-z0-9]([-a-z0-9.]*[a-z0-9])?)/([-._a-zA-Z0-9]+)\}`)
+
+	secretRefEnvInvalidCharacters = regexp.MustCompile(`[^A-Z0-9_]`)
+)
+
+// secretRefsToEnv replaces secret references in telegraf configuration with references to environment variables
+// and returns the environment variables, set from keys of secrets in the pod's namespace, that the sidecar needs.
+func secretRefsToEnv(telegrafConf string) (string, []corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	refs := map[string]string{}
+	var err error
+
+	telegrafConf = secretRefRegexp.ReplaceAllStringFunc(telegrafConf, func(ref string) string {
+		match := secretRefRegexp.FindStringSubmatch(ref)
+		name, key := match[1], match[3]
+		envName := secretRefEnvName(name, key)
+
+		if existing, ok := refs[envName]; !ok {
+			refs[envName] = ref
+			env = append(env, corev1.EnvVar{
+				Name: envName,
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: name},
+						Key:                  key,
+					},
+				},
+			})
+		} else if existing != ref && err == nil {
+			err = fmt.Errorf("secret references %s and %s map to the same environment variable %s", existing, ref, envName)
+		}
+
+		return fmt.Sprintf("${%s}", envName)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if index := strings.Index(telegrafConf, secretRefPrefix); index >= 0 {
+		ref := telegrafConf[index:]
+		if end := strings.Index(ref, "}"); end >= 0 {
+			ref = ref[:end+1]
+		}
+		return "", nil, fmt.Errorf("invalid secret reference %s, expected ${secretRef:<name>/<key>}", ref)
+	}
+
+	return telegrafConf, env, nil
+}
+
+// secretRefEnvNames returns names of environment variables that secret references in the text are replaced with.
+func secretRefEnvNames(text string) map[string]bool {
+	names := map[string]bool{}
+	for _, match := range secretRefRegexp.FindAllStringSubmatch(text, -1) {
+		names[secretRefEnvName(match[1], match[3])] = true
+	}
+	return names
+}
+
+// secretRefEnvName returns name of the environment variable for a key of a secret.
+func secretRefEnvName(name, key string) string {
+	return secretRefEnvPrefix + secretRefEnvInvalidCharacters.ReplaceAllString(strings.ToUpper(name+"_"+key), "_")
+}
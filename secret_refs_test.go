@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func secretKeyRefEnv(envName, name, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: envName,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func Test_secretRefsToEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     string
+		wantConf string
+		wantEnv  []corev1.EnvVar
+		wantErr  bool
+	}{
+		{
+			name:     "configuration without secret references",
+			conf:     `token = "${TOKEN}"`,
+			wantConf: `token = "${TOKEN}"`,
+		},
+		{
+			name: "secret references are replaced once per key",
+			conf: `token = "${secretRef:influxdb-auth/token}"
+password = "${secretRef:influxdb-auth/token}"
+username = "${secretRef:db.credentials/user.name}"`,
+			wantConf: `token = "${SECRET_INFLUXDB_AUTH_TOKEN}"
+password = "${SECRET_INFLUXDB_AUTH_TOKEN}"
+username = "${SECRET_DB_CREDENTIALS_USER_NAME}"`,
+			wantEnv: []corev1.EnvVar{
+				secretKeyRefEnv("SECRET_INFLUXDB_AUTH_TOKEN", "influxdb-auth", "token"),
+				secretKeyRefEnv("SECRET_DB_CREDENTIALS_USER_NAME", "db.credentials", "user.name"),
+			},
+		},
+		{
+			name:    "references mapping to the same environment variable",
+			conf:    `token = "${secretRef:influxdb-auth/token}" password = "${secretRef:influxdb/auth-token}"`,
+			wantErr: true,
+		},
+		{
+			name:    "reference without key",
+			conf:    `token = "${secretRef:influxdb-auth}"`,
+			wantErr: true,
+		},
+		{
+			name:    "reference with invalid secret name",
+			conf:    `token = "${secretRef:InfluxDB/token}"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotConf, gotEnv, err := secretRefsToEnv(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("secretRefsToEnv() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotConf != tt.wantConf {
+				t.Errorf("secretRefsToEnv() conf = %v, want %v", gotConf, tt.wantConf)
+			}
+			if !reflect.DeepEqual(gotEnv, tt.wantEnv) {
+				t.Errorf("secretRefsToEnv() env = %v, want %v", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// secretStoresPath is the directory that telegraf's docker secret store reads secrets from.
+const secretStoresPath = "/run/secrets"
+
+// secretStoreRefRegexp matches references to secrets in telegraf configuration, such as "@{influxdb:token}",
+// capturing the ID of the secret store and the key.
+var secretStoreRefRegexp = regexp.MustCompile(`@\{(\w+):(\w+)\}`)
+
+// secretStores returns configuration of secret stores for references to stores that the class maps to Kubernetes
+// secrets, and keys of the secrets to mount for them; references to other secret stores are left as is.
+//
+// All stores use telegraf's docker secret store, which reads each key from a file in the same directory,
+// so a key may only be referenced from a single secret.
+func secretStores(telegrafConf string, stores map[string]string) (string, []corev1.VolumeProjection, error) {
+	usedStores := map[string]bool{}
+	keySecrets := map[string]string{}
+	items := map[string][]corev1.KeyToPath{}
+
+	for _, match := range secretStoreRefRegexp.FindAllStringSubmatch(telegrafConf, -1) {
+		store, key := match[1], match[2]
+		secretName, ok := stores[store]
+		if !ok {
+			continue
+		}
+		usedStores[store] = true
+
+		if existing, ok := keySecrets[key]; ok {
+			if existing != secretName {
+				return "", nil, fmt.Errorf("key %s is referenced from both secret %s and secret %s", key, existing, secretName)
+			}
+			continue
+		}
+		keySecrets[key] = secretName
+		items[secretName] = append(items[secretName], corev1.KeyToPath{Key: key, Path: key})
+	}
+
+	var ids []string
+	for store := range usedStores {
+		ids = append(ids, store)
+	}
+	sort.Strings(ids)
+
+	conf := ""
+	for _, id := range ids {
+		conf = fmt.Sprintf("%s\n[[secretstores.docker]]\n  id = %q\n", conf, id)
+	}
+
+	var secretNames []string
+	for secretName := range items {
+		secretNames = append(secretNames, secretName)
+	}
+	sort.Strings(secretNames)
+
+	var projections []corev1.VolumeProjection
+	for _, secretName := range secretNames {
+		projections = append(projections, corev1.VolumeProjection{
+			Secret: &corev1.SecretProjection{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Items:                items[secretName],
+			},
+		})
+	}
+
+	return conf, projections, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_secretStores(t *testing.T) {
+	stores := map[string]string{"influxdb": "influxdb-auth", "kafka": "kafka-auth", "unused": "unused"}
+
+	tests := []struct {
+		name            string
+		conf            string
+		wantConf        string
+		wantProjections []corev1.VolumeProjection
+		wantErr         bool
+	}{
+		{
+			name: "no references",
+			conf: `token = "${TOKEN}"`,
+		},
+		{
+			name: "references to stores not declared by class are ignored",
+			conf: `token = "@{vault:token}"`,
+		},
+		{
+			name: "references to declared stores",
+			conf: `token = "@{influxdb:token}"
+username = "@{kafka:username}"
+password = "@{kafka:password}"
+other_token = "@{influxdb:token}"`,
+			wantConf: `
+[[secretstores.docker]]
+  id = "influxdb"
+
+[[secretstores.docker]]
+  id = "kafka"
+`,
+			wantProjections: []corev1.VolumeProjection{
+				{Secret: &corev1.SecretProjection{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "influxdb-auth"},
+					Items:                []corev1.KeyToPath{{Key: "token", Path: "token"}},
+				}},
+				{Secret: &corev1.SecretProjection{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "kafka-auth"},
+					Items:                []corev1.KeyToPath{{Key: "username", Path: "username"}, {Key: "password", Path: "password"}},
+				}},
+			},
+		},
+		{
+			name:    "same key in multiple secrets",
+			conf:    `token = "@{influxdb:token}" other_token = "@{kafka:token}"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotConf, gotProjections, err := secretStores(tt.conf, stores)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("secretStores() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotConf != tt.wantConf {
+				t.Errorf("secretStores() conf = %v, want %v", gotConf, tt.wantConf)
+			}
+			if !reflect.DeepEqual(gotProjections, tt.wantProjections) {
+				t.Errorf("secretStores() projections = %v, want %v", gotProjections, tt.wantProjections)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// serviceAccountTokenPath is the directory in which the projected service account token is mounted
+	serviceAccountTokenPath = "/var/run/telegraf/serviceaccount"
+	// serviceAccountTokenFile is the name of the projected service account token file
+	serviceAccountTokenFile = "token"
+	// serviceAccountTokenEnv is the environment variable that the path of the projected service account token is passed as
+	serviceAccountTokenEnv = "SERVICE_ACCOUNT_TOKEN_FILE"
+
+	defaultServiceAccountTokenExpiration = time.Hour
+	// minServiceAccountTokenExpiration is the shortest lifetime of a token that Kubernetes allows
+	minServiceAccountTokenExpiration = 10 * time.Minute
+)
+
+// serviceAccountToken returns the projected service account token to mount in the sidecar, based on the pod's
+// annotations and the class settings, which the annotations take precedence over; nil is returned if no audience
+// is configured.
+func serviceAccountToken(pod *corev1.Pod, settings *classSettings) (*corev1.ServiceAccountTokenProjection, error) {
+	var audience, expiration string
+	if settings.ServiceAccountToken != nil {
+		audience = settings.ServiceAccountToken.Audience
+		expiration = settings.ServiceAccountToken.Expiration
+	}
+	if value, ok := pod.Annotations[TelegrafServiceAccountTokenAudience]; ok {
+		audience = value
+	}
+	if value, ok := pod.Annotations[TelegrafServiceAccountTokenExpiration]; ok {
+		expiration = value
+	}
+
+	if audience == "" {
+		return nil, nil
+	}
+
+	duration := defaultServiceAccountTokenExpiration
+	if expiration != "" {
+		var err error
+		duration, err = time.ParseDuration(expiration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service account token expiration %s: %v", expiration, err)
+		}
+		if duration < minServiceAccountTokenExpiration {
+			return nil, fmt.Errorf("service account token expiration must be at least %s, %s given", minServiceAccountTokenExpiration, expiration)
+		}
+	}
+
+	expirationSeconds := int64(duration / time.Second)
+	return &corev1.ServiceAccountTokenProjection{
+		Audience:          audience,
+		ExpirationSeconds: &expirationSeconds,
+		Path:              serviceAccountTokenFile,
+	}, nil
+}
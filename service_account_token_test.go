@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_serviceAccountToken(t *testing.T) {
+	hour := int64(3600)
+	day := int64(86400)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		settings    *classSettings
+		want        *corev1.ServiceAccountTokenProjection
+		wantErr     bool
+	}{
+		{
+			name:     "disabled by default",
+			settings: &classSettings{},
+		},
+		{
+			name:     "class settings with default expiration",
+			settings: &classSettings{ServiceAccountToken: &serviceAccountTokenSettings{Audience: "gateway"}},
+			want:     &corev1.ServiceAccountTokenProjection{Audience: "gateway", ExpirationSeconds: &hour, Path: "token"},
+		},
+		{
+			name: "annotations take precedence over class settings",
+			annotations: map[string]string{
+				TelegrafServiceAccountTokenAudience:   "other-gateway",
+				TelegrafServiceAccountTokenExpiration: "24h",
+			},
+			settings: &classSettings{ServiceAccountToken: &serviceAccountTokenSettings{Audience: "gateway", Expiration: "2h"}},
+			want:     &corev1.ServiceAccountTokenProjection{Audience: "other-gateway", ExpirationSeconds: &day, Path: "token"},
+		},
+		{
+			name:        "annotation disables class token",
+			annotations: map[string]string{TelegrafServiceAccountTokenAudience: ""},
+			settings:    &classSettings{ServiceAccountToken: &serviceAccountTokenSettings{Audience: "gateway"}},
+		},
+		{
+			name: "invalid expiration",
+			annotations: map[string]string{
+				TelegrafServiceAccountTokenAudience:   "gateway",
+				TelegrafServiceAccountTokenExpiration: "1 hour",
+			},
+			settings: &classSettings{},
+			wantErr:  true,
+		},
+		{
+			name: "expiration too short",
+			annotations: map[string]string{
+				TelegrafServiceAccountTokenAudience:   "gateway",
+				TelegrafServiceAccountTokenExpiration: "5m",
+			},
+			settings: &classSettings{},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			got, err := serviceAccountToken(pod, tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("serviceAccountToken() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serviceAccountToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
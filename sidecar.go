@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/go-logr/logr"
 	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	istioInputsConf = `
   [[inputs.prometheus]]
-    urls = ["http://127.0.0.1:15090/stats/prometheus"]
+    urls = [%s]
 `
 )
 
@@ -40,10 +49,28 @@ const (
 	TelegrafMetricVersion = "telegraf.influxdata.com/metric-version"
 	// TelegrafMetricsNamepass is used to specify value for namepass for Prometheus metrics, as raw TOML configuration
 	TelegrafMetricsNamepass = "telegraf.influxdata.com/namepass"
+	// TelegrafScrapeTargets is used to configure multiple prometheus endpoints to scrape, each with its own settings, as JSON or YAML list
+	TelegrafScrapeTargets = "telegraf.influxdata.com/scrape-targets"
+	// TelegrafScrapeHost is used to configure host to scrape metrics from; "pod-ip" and "pod-ipv6" use the IP address of the pod
+	TelegrafScrapeHost = "telegraf.influxdata.com/scrape-host"
 	// TelegrafInterval is used to configure interval for telegraf (Go style duration, e.g 5s, 30s, 2m .. )
 	TelegrafInterval = "telegraf.influxdata.com/interval"
 	// TelegrafRawInput is used to configure custom inputs for telegraf
 	TelegrafRawInput = "telegraf.influxdata.com/inputs"
+	// TelegrafAgent is used to configure settings of the telegraf [agent] table, as TOML key-value pairs; they take precedence over settings in the class
+	TelegrafAgent = "telegraf.influxdata.com/agent"
+	// TelegrafInputsConfigMap is used to configure custom inputs for telegraf from a key of a ConfigMap in the pod's namespace, as name/key
+	TelegrafInputsConfigMap = "telegraf.influxdata.com/inputs-configmap"
+	// TelegrafLogs is used to collect logs of application containers, as JSON mapping container names to their log path, format, files and grok patterns
+	TelegrafLogs = "telegraf.influxdata.com/logs"
+	// TelegrafListeners is used to enable input plugins listening for metrics pushed by application containers, as comma separated list of statsd, influxdb_listener and opentelemetry with optional ports, eg: statsd,opentelemetry:4318
+	TelegrafListeners = "telegraf.influxdata.com/listeners"
+	// TelegrafProcstat is used to monitor processes of application containers by sharing the pod's process namespace, as JSON mapping container names to patterns of the processes, eg: {"app": "java .*server.jar"}
+	TelegrafProcstat = "telegraf.influxdata.com/procstat"
+	// TelegrafProcessors is used to configure custom processors for telegraf, only processor plugins are allowed
+	TelegrafProcessors = "telegraf.influxdata.com/processors"
+	// TelegrafAggregators is used to configure custom aggregators for telegraf, only aggregator plugins are allowed
+	TelegrafAggregators = "telegraf.influxdata.com/aggregators"
 	// TelegrafEnableInternal enabled internal input plugins for
 	TelegrafEnableInternal = "telegraf.influxdata.com/internal"
 	// TelegrafClass configures which kind of class to use (classes are configured on the operator)
@@ -80,7 +107,26 @@ const (
 	IstioTelegrafLimitsMemory = "telegraf.influxdata.com/istio-limits-memory"
 	// TelegrafVolumeMounts allows specifying custom extra volumes to mount on telegraf sidecar, should be json formatted, eg: {"volumeName": "mountPath"}
 	TelegrafVolumeMounts = "telegraf.influxdata.com/volume-mounts"
-	telegrafSecretInfix  = "config"
+	// TelegrafServiceAccountTokenAudience enables mounting a projected service account token with the specified audience in telegraf sidecar
+	TelegrafServiceAccountTokenAudience = "telegraf.influxdata.com/service-account-token-audience"
+	// TelegrafServiceAccountTokenExpiration allows specifying requested lifetime of the projected service account token (Go style duration, at least 10m)
+	TelegrafServiceAccountTokenExpiration = "telegraf.influxdata.com/service-account-token-expiration"
+	// TelegrafBufferSizeLimit enables buffering metrics on disk, using a volume with the specified size limit, eg: 1Gi
+	TelegrafBufferSizeLimit = "telegraf.influxdata.com/buffer-size-limit"
+	// TelegrafBufferMedium allows specifying the medium backing the buffer volume, disk or memory; defaults to disk
+	TelegrafBufferMedium = "telegraf.influxdata.com/buffer-medium"
+	// TelegrafResourcesProfile allows selecting a named profile of resources and agent buffer settings configured for the operator
+	TelegrafResourcesProfile = "telegraf.influxdata.com/resources-profile"
+	// TelegrafResolvedImagePrefix is set by telegraf-operator to record the image used for each sidecar container after resolving it
+	TelegrafResolvedImagePrefix = "telegraf.influxdata.com/resolved-image-"
+	telegrafSecretInfix         = "config"
+
+	// ScrapeHostPodIP is the scrape host setting for scraping the pod's IPv4 address
+	ScrapeHostPodIP = "pod-ip"
+	// ScrapeHostPodIPv6 is the scrape host setting for scraping the pod's IPv6 address
+	ScrapeHostPodIPv6 = "pod-ipv6"
+	// podIPEnv is the environment variable that the pod's IP address is passed as when scraping the pod's IP address
+	podIPEnv = "POD_IP"
 
 	TelegrafSecretAnnotationKey   = "app.kubernetes.io/managed-by"
 	TelegrafSecretAnnotationValue = "telegraf-operator"
@@ -92,6 +138,10 @@ const (
 // sidecarHandler provides logic for handling telegraf sidecars and related secrets.
 type sidecarHandler struct {
 	ClassDataHandler            classDataHandler
+	Client                      client.Reader
+	ImageResolver               *imageResolver
+	ClientCertIssuer            *clientCertIssuer
+	ResourcesProfiles           map[string]*resourcesProfile
 	Logger                      logr.Logger
 	TelegrafDefaultClass        string
 	TelegrafImage               string
@@ -109,11 +159,22 @@ type sidecarHandler struct {
 	IstioOutputClass            string
 	IstioTelegrafImage          string
 	IstioTelegrafWatchConfig    string
+	EnableScrapeDiscovery       bool
+	ScrapeDiscoveryPortNames    []string
+	ScrapeHost                  string
+	DownwardAPIEnv              []string
+	DownwardAPILabels           []string
+	EnableMetadataTags          bool
+	MetadataTagsLabels          []string
 }
 
 type sidecarHandlerResponse struct {
 	// list of secrets to create alongside with the changes
 	secrets []*corev1.Secret
+	// list of containers added to the pod, matching secrets at the same index
+	containers []corev1.Container
+	// list of configurations of the containers, matching secrets at the same index
+	confs []*sidecarConf
 }
 
 // This function check if the pod have the correct annotations, otherwise the controller will skip this pod entirely
@@ -127,12 +188,18 @@ func (h *sidecarHandler) shouldAddTelegrafSidecar(pod *corev1.Pod) bool {
 	}
 
 	for key := range pod.GetAnnotations() {
+		// annotations set by telegraf-operator itself should not cause the sidecar to be added
+		if strings.HasPrefix(key, TelegrafResolvedImagePrefix) || key == TelegrafOriginalPrometheusAnnotations {
+			continue
+		}
 		if strings.Contains(key, TelegrafAnnotationCommon) {
 			return true
 		}
 	}
 
-	return false
+	// invalid annotations still cause the sidecar to be added, so that the error is reported
+	targets, err := h.discoverScrapeTargets(pod)
+	return err != nil || len(targets) > 0
 }
 
 func (h *sidecarHandler) shouldAddIstioTelegrafSidecar(pod *corev1.Pod) bool {
@@ -173,17 +240,64 @@ func (h *sidecarHandler) telegrafSecretNames(name string) []string {
 	}
 }
 
+// withNamespaceDefaults returns a copy of the pod with telegraf-operator annotations of its namespace
+// added as defaults; annotations set on the pod itself always take precedence over the namespace ones.
+func (h *sidecarHandler) withNamespaceDefaults(pod *corev1.Pod, namespace string) (*corev1.Pod, error) {
+	if h.Client == nil || namespace == "" {
+		return pod, nil
+	}
+
+	ns := &corev1.Namespace{}
+	err := h.Client.Get(context.Background(), types.NamespacedName{Name: namespace}, ns)
+	if apierrors.IsNotFound(err) {
+		return pod, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get namespace %s: %v", namespace, err)
+	}
+
+	defaults := AnnotationsWithPrefix(ns.GetAnnotations(), TelegrafAnnotationCommon+"/")
+	if len(defaults) == 0 {
+		return pod, nil
+	}
+
+	result := pod.DeepCopy()
+	if result.Annotations == nil {
+		result.Annotations = map[string]string{}
+	}
+	for key, value := range defaults {
+		key = TelegrafAnnotationCommon + "/" + key
+		if _, ok := result.Annotations[key]; !ok {
+			result.Annotations[key] = value
+		}
+	}
+
+	return result, nil
+}
+
 func (h *sidecarHandler) addSidecars(pod *corev1.Pod, name, namespace string) (*sidecarHandlerResponse, error) {
 	result := &sidecarHandlerResponse{}
+
+	// all settings are read from the pod with namespace defaults applied, while containers and volumes
+	// are added to the original pod, so that the namespace annotations are not copied into the pod
+	podWithDefaults, err := h.withNamespaceDefaults(pod, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if podWithDefaults.Namespace == "" {
+		// the namespace may not be set in the pod when it is created, but is needed when assembling configuration
+		podWithDefaults = podWithDefaults.DeepCopy()
+		podWithDefaults.Namespace = namespace
+	}
+
 	if h.shouldAddTelegrafSidecar(pod) {
-		err := h.addTelegrafSidecar(result, pod, name, namespace, "telegraf")
+		err := h.addTelegrafSidecar(result, pod, podWithDefaults, name, namespace, "telegraf")
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if h.shouldAddIstioTelegrafSidecar(pod) {
-		err := h.addIstioTelegrafSidecar(result, pod, name, namespace)
+		err := h.addIstioTelegrafSidecar(result, pod, podWithDefaults, name, namespace)
 		if err != nil {
 			return nil, err
 		}
@@ -191,65 +305,196 @@ func (h *sidecarHandler) addSidecars(pod *corev1.Pod, name, namespace string) (*
 	return result, nil
 }
 
-func (h *sidecarHandler) addTelegrafSidecar(result *sidecarHandlerResponse, pod *corev1.Pod, name, namespace, containerName string) error {
+func (h *sidecarHandler) addTelegrafSidecar(result *sidecarHandlerResponse, pod, podWithDefaults *corev1.Pod, name, namespace, containerName string) error {
 	className := h.TelegrafDefaultClass
-	if extClass, ok := pod.Annotations[TelegrafClass]; ok {
+	if extClass, ok := podWithDefaults.Annotations[TelegrafClass]; ok {
 		className = extClass
 	}
 
-	telegrafConf, err := h.assembleConf(pod, className)
+	// unknown resources profiles are reported, rather than creating the pod without the sidecar
+	if _, err := h.resourcesProfile(podWithDefaults); err != nil {
+		return err
+	}
+
+	conf, err := h.assembleSidecarConf(podWithDefaults, className)
 	if err != nil {
 		return newNonFatalError(err, "telegraf-operator could not create sidecar container due to error in class data")
 	}
 
-	container, err := h.newContainer(pod, containerName)
+	// prometheus annotations that would stop prometheus from scraping the application are reported, rather than
+	// creating the pod without the sidecar
+	if err := conf.prometheusClient.checkScrapedPort(podWithDefaults, conf.scrapedPorts); err != nil {
+		return err
+	}
+
+	container, err := h.newContainer(podWithDefaults, containerName, conf)
 	if err != nil {
 		return err
 	}
 
-	return h.addContainerAndSecret(result, pod, container, className, name, namespace, telegrafConf)
+	return h.addContainerAndSecret(result, pod, container, className, name, namespace, conf)
 }
 
-func (h *sidecarHandler) addIstioTelegrafSidecar(result *sidecarHandlerResponse, pod *corev1.Pod, name, namespace string) error {
-	classData, err := h.ClassDataHandler.getData(h.IstioOutputClass)
+func (h *sidecarHandler) addIstioTelegrafSidecar(result *sidecarHandlerResponse, pod, podWithDefaults *corev1.Pod, name, namespace string) error {
+	classData, err := h.getClassData(podWithDefaults, h.IstioOutputClass)
 	if err != nil {
 		return newNonFatalError(err, "telegraf-operator could not create sidecar container for istio class")
 	}
+	_, classData, err = parseClassData(classData)
+	if err != nil {
+		return newNonFatalError(err, "telegraf-operator could not create sidecar container due to error in istio class data")
+	}
 
-	telegrafConf := fmt.Sprintf("%s\n\n%s", istioInputsConf, classData)
+	host, err := h.scrapeHost(podWithDefaults)
+	if err != nil {
+		return err
+	}
+	conf := &sidecarConf{}
+	istioURL := fmt.Sprintf("http://%s:15090/stats/prometheus", host)
+	telegrafConf := fmt.Sprintf("%s\n\n%s", fmt.Sprintf(istioInputsConf, tomlString(istioURL)), classData)
+	conf.telegrafConf, conf.env, err = secretRefsToEnv(telegrafConf)
+	if err != nil {
+		return newNonFatalError(err, "telegraf-operator could not create sidecar container due to error in istio class data")
+	}
 
-	container, err := h.newIstioContainer(pod, "telegraf-istio")
+	container, err := h.newIstioContainer(podWithDefaults, "telegraf-istio", conf)
 	if err != nil {
 		return err
 	}
 
-	return h.addContainerAndSecret(result, pod, container, h.IstioOutputClass, name, namespace, telegrafConf)
+	return h.addContainerAndSecret(result, pod, container, h.IstioOutputClass, name, namespace, conf)
 }
 
-func (h *sidecarHandler) addContainerAndSecret(result *sidecarHandlerResponse, pod *corev1.Pod, container corev1.Container, className, name, namespace, telegrafConf string) error {
+func (h *sidecarHandler) addContainerAndSecret(result *sidecarHandlerResponse, pod *corev1.Pod, container corev1.Container, className, name, namespace string, conf *sidecarConf) error {
 	pod.Spec.Containers = append(pod.Spec.Containers, container)
 	pod.Spec.Volumes = append(pod.Spec.Volumes, h.newVolume(name, container.Name))
-	secret, err := h.newSecret(pod, className, name, namespace, container.Name, telegrafConf)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, conf.volumes(container.Name)...)
+	addLogsVolumeMounts(pod, container.Name, conf.logs)
+	addListenersEnv(pod, conf.listeners)
+	if len(conf.procstat) > 0 {
+		shareProcessNamespace(pod)
+	}
+	if err := addPrometheusAnnotations(pod, conf.prometheusClient); err != nil {
+		return err
+	}
+	if h.ImageResolver != nil {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[TelegrafResolvedImagePrefix+container.Name] = container.Image
+	}
+	secret, err := h.newSecret(pod, className, name, namespace, container.Name, conf.telegrafConf)
 	if err != nil {
 		return err
 	}
+	if conf.clientCertificate != nil {
+		data, err := h.ClientCertIssuer.issue(context.Background(), *conf.clientCertificate)
+		if err != nil {
+			return err
+		}
+		for key, value := range data {
+			secret.StringData[key] = string(value)
+		}
+	}
+	if conf.inputsConfigMap != "" {
+		// record the ConfigMap in the secret, so that it is updated when the ConfigMap changes
+		secret.Annotations[TelegrafInputsConfigMap] = conf.inputsConfigMap
+	}
 	result.secrets = append(result.secrets, secret)
+	result.containers = append(result.containers, container)
+	result.confs = append(result.confs, conf)
 
 	return nil
 }
 
-func (h *sidecarHandler) getClassData(className string) (string, error) {
-	return h.ClassDataHandler.getData(className)
+// getClassData returns class data for the pod; if the class is a template, it is rendered for the pod.
+func (h *sidecarHandler) getClassData(pod *corev1.Pod, className string) (string, error) {
+	data, err := h.ClassDataHandler.getData(className)
+	if err == nil && !strings.HasSuffix(className, classTemplateSuffix) {
+		return data, nil
+	}
+	if err != nil {
+		className = className + classTemplateSuffix
+		var templateErr error
+		if data, templateErr = h.ClassDataHandler.getData(className); templateErr != nil {
+			return "", err
+		}
+	}
+
+	data, err = renderClassTemplate(className, data, h.newClassTemplateContext(pod))
+	if err != nil {
+		return "", fmt.Errorf("unable to render class %s: %v", className, err)
+	}
+	return data, nil
+}
+
+// assembleSidecarConfWithNamespaceDefaults assembles telegraf configuration for an existing pod,
+// applying defaults from annotations of the pod's namespace.
+func (h *sidecarHandler) assembleSidecarConfWithNamespaceDefaults(pod *corev1.Pod, className string) (*sidecarConf, error) {
+	podWithDefaults, err := h.withNamespaceDefaults(pod, pod.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+
+	return h.assembleSidecarConf(podWithDefaults, className)
 }
 
 // Assembling telegraf configuration
-func (h *sidecarHandler) assembleConf(pod *corev1.Pod, className string) (telegrafConf string, err error) {
-	classData, err := h.ClassDataHandler.getData(className)
+func (h *sidecarHandler) assembleConf(pod *corev1.Pod, className string) (string, error) {
+	conf, err := h.assembleSidecarConf(pod, className)
 	if err != nil {
-		return "", newNonFatalError(err, "telegraf-operator could not create sidecar container for unknown class")
+		return "", err
 	}
+	return conf.telegrafConf, nil
+}
 
-	ports := ports(pod)
+// assembleSidecarConf assembles telegraf configuration along with what the sidecar container needs for it.
+func (h *sidecarHandler) assembleSidecarConf(pod *corev1.Pod, className string) (*sidecarConf, error) {
+	var telegrafConf string
+	classData, err := h.getClassData(pod, className)
+	if err != nil {
+		return nil, newNonFatalError(err, "telegraf-operator could not create sidecar container for unknown class")
+	}
+	settings, classData, err := parseClassData(classData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse class %s: %v", className, err)
+	}
+	bufferVolume, err := buffer(pod, settings)
+	if err != nil {
+		return nil, err
+	}
+	if bufferVolume != nil {
+		classData, err = mergeAgentConf(classData, bufferAgentConf(), bufferAgentSource)
+		if err != nil {
+			return nil, err
+		}
+	}
+	profile, err := h.resourcesProfile(pod)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil && profile.agentConf() != "" {
+		classData, err = mergeAgentConf(classData, profile.agentConf(), fmt.Sprintf("agent settings of resources profile %s", pod.Annotations[TelegrafResourcesProfile]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if agentRaw, ok := pod.Annotations[TelegrafAgent]; ok {
+		classData, err = mergeAgentConf(classData, agentRaw, agentAnnotationSource)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ports, err := resolvePorts(pod, ports(pod))
+	if err != nil {
+		return nil, err
+	}
+	scrapedPorts := append([]string{}, ports...)
+	host, err := h.scrapeHost(pod)
+	if err != nil {
+		return nil, err
+	}
 	if len(ports) != 0 {
 		path := "/metrics"
 		if extPath, ok := pod.Annotations[TelegrafMetricsPath]; ok {
@@ -264,29 +509,55 @@ func (h *sidecarHandler) assembleConf(pod *corev1.Pod, className string) (telegr
 
 		intervalRaw, ok := pod.Annotations[TelegrafInterval]
 		if ok {
-			additionalConfig = fmt.Sprintf("%s  interval = \"%s\"\n", additionalConfig, intervalRaw)
+			additionalConfig = fmt.Sprintf("%s  interval = %s\n", additionalConfig, tomlString(intervalRaw))
 		}
 
 		if versionRaw, ok := pod.Annotations[TelegrafMetricVersion]; ok {
 			version, err := strconv.ParseInt(versionRaw, 10, 0)
 			if err != nil {
-				return "", fmt.Errorf("value supplied for %s must be a number, %s given", TelegrafMetricVersion, versionRaw)
+				return nil, fmt.Errorf("value supplied for %s must be a number, %s given", TelegrafMetricVersion, versionRaw)
 			}
 
 			additionalConfig = fmt.Sprintf("%s  metric_version = %d\n", additionalConfig, version)
 		}
 
-		if namepass, ok := pod.Annotations[TelegrafMetricsNamepass]; ok {
+		if namepassRaw, ok := pod.Annotations[TelegrafMetricsNamepass]; ok {
+			namepass, err := parseNamepass(namepassRaw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s annotation: %v", TelegrafMetricsNamepass, err)
+			}
 			additionalConfig = fmt.Sprintf("%s  namepass = %s\n", additionalConfig, namepass)
 		}
 
 		urls := []string{}
 		for _, port := range ports {
-			urls = append(urls, fmt.Sprintf("%s://127.0.0.1:%s%s", scheme, port, path))
+			urls = append(urls, fmt.Sprintf("%s://%s:%s%s", scheme, host, port, path))
 		}
 
-		telegrafConf = fmt.Sprintf("%s\n[[inputs.prometheus]]\n  urls = [\"%s\"]\n%s\n", telegrafConf, strings.Join(urls, `", "`), additionalConfig)
+		telegrafConf = fmt.Sprintf("%s\n[[inputs.prometheus]]\n  urls = %s\n%s\n", telegrafConf, tomlStringArray(urls), additionalConfig)
+	}
+
+	targets, err := scrapeTargets(pod)
+	if err != nil {
+		return nil, err
+	}
+	// discovered targets are only used if the pod does not explicitly specify what to scrape
+	if len(ports) == 0 && len(targets) == 0 {
+		targets, err = h.discoverScrapeTargets(pod)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, target := range targets {
+		port, err := resolvePort(pod, target.Port.String())
+		if err != nil {
+			return nil, err
+		}
+		target.Port = intstr.Parse(port)
+		scrapedPorts = append(scrapedPorts, port)
+		telegrafConf = fmt.Sprintf("%s%s", telegrafConf, target.inputConf(host))
 	}
+
 	enableInternal := h.EnableDefaultInternalPlugin
 	if internalRaw, ok := pod.Annotations[TelegrafEnableInternal]; ok {
 		internal, err := strconv.ParseBool(internalRaw)
@@ -300,17 +571,79 @@ func (h *sidecarHandler) assembleConf(pod *corev1.Pod, className string) (telegr
 	if enableInternal {
 		telegrafConf = fmt.Sprintf("%s\n%s", telegrafConf, fmt.Sprintf("[[inputs.internal]]\n"))
 	}
+	var rawInputs string
 	if inputsRaw, ok := pod.Annotations[TelegrafRawInput]; ok {
-		telegrafConf = fmt.Sprintf("%s\n%s", telegrafConf, inputsRaw)
+		rawInputs = fmt.Sprintf("%s\n%s", rawInputs, inputsRaw)
+	}
+	inputsConfigMap, hasInputsConfigMap := pod.Annotations[TelegrafInputsConfigMap]
+	if hasInputsConfigMap {
+		inputsRaw, err := h.inputsFromConfigMap(pod.Namespace, inputsConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		rawInputs = fmt.Sprintf("%s\n%s", rawInputs, inputsRaw)
+	}
+	logs, err := parseLogsSettings(pod)
+	if err != nil {
+		return nil, err
+	}
+	if len(logs) > 0 {
+		rawInputs = fmt.Sprintf("%s\n%s", rawInputs, logsInputs(logs))
+	}
+	listeners, err := parseListeners(pod)
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		rawInputs = fmt.Sprintf("%s\n%s", rawInputs, listenersInputs(listeners))
+	}
+	procstat, err := parseProcstatSettings(pod)
+	if err != nil {
+		return nil, err
+	}
+	if len(procstat) > 0 {
+		rawInputs = fmt.Sprintf("%s\n%s", rawInputs, procstatInputs(procstat))
+	}
+	promClient, err := prometheusClient(pod, settings, listeners)
+	if err != nil {
+		return nil, err
+	}
+	telegrafConf = fmt.Sprintf("%s%s", telegrafConf, rawInputs)
+	rawPlugins := map[string]string{}
+	for _, plugins := range []struct{ annotation, kind string }{
+		{TelegrafProcessors, processorsKind},
+		{TelegrafAggregators, aggregatorsKind},
+	} {
+		if pluginsRaw, ok := pod.Annotations[plugins.annotation]; ok {
+			if err := validatePluginTables(pluginsRaw, plugins.kind); err != nil {
+				return nil, fmt.Errorf("invalid %s annotation: %v", plugins.annotation, err)
+			}
+			telegrafConf = fmt.Sprintf("%s\n%s", telegrafConf, pluginsRaw)
+			rawPlugins[plugins.kind] = pluginsRaw
+		}
 	}
 	telegrafConf = fmt.Sprintf("%s\n%s", telegrafConf, classData)
+	if promClient != nil {
+		telegrafConf = fmt.Sprintf("%s\n%s", telegrafConf, promClient.outputConf())
+	}
+
+	tags := map[string]string{}
+	if h.metadataTagsEnabled(settings) {
+		tags = h.metadataTags(pod, settings)
+	}
+	// tags set by the class take precedence over metadata tags, as they can not be set twice
+	for key := range classGlobalTags(classData) {
+		delete(tags, key)
+	}
+	// tags specified explicitly for the pod take precedence over metadata tags
+	for key, value := range AnnotationsWithPrefix(pod.Annotations, TelegrafGlobalTagLiteralPrefix) {
+		tags[key] = value
+	}
 
 	type keyValue struct{ key, value string }
 	var globalTags []keyValue
-	for key, value := range pod.Annotations {
-		if strings.HasPrefix(key, TelegrafGlobalTagLiteralPrefix) {
-			globalTags = append(globalTags, keyValue{strings.TrimPrefix(key, TelegrafGlobalTagLiteralPrefix), value})
-		}
+	for key, value := range tags {
+		globalTags = append(globalTags, keyValue{key, value})
 	}
 	// Go maps aren't ordered; we want a stable config output, to simplify tests among other things
 	sort.Slice(globalTags, func(i, j int) bool { return globalTags[i].key < globalTags[j].key })
@@ -318,7 +651,7 @@ func (h *sidecarHandler) assembleConf(pod *corev1.Pod, className string) (telegr
 	if len(globalTags) > 0 {
 		globalTagsText := "[global_tags]\n"
 		for _, i := range globalTags {
-			globalTagsText = fmt.Sprintf("%s  %s = %q\n", globalTagsText, i.key, i.value)
+			globalTagsText = fmt.Sprintf("%s  %s = %q\n", globalTagsText, tomlKey(i.key), i.value)
 		}
 
 		// inject globalTagsText at the top of an existing "[global_tags]" section
@@ -332,11 +665,79 @@ func (h *sidecarHandler) assembleConf(pod *corev1.Pod, className string) (telegr
 		telegrafConf = strings.ReplaceAll(telegrafConf, "[global_tags]\n", globalTagsText)
 	}
 
+	conf := &sidecarConf{
+		rawInputs:        rawInputs,
+		rawProcessors:    rawPlugins[processorsKind],
+		rawAggregators:   rawPlugins[aggregatorsKind],
+		inputsConfigMap:  inputsConfigMap,
+		logs:             logs,
+		listeners:        listeners,
+		procstat:         procstat,
+		buffer:           bufferVolume,
+		prometheusClient: promClient,
+		scrapedPorts:     scrapedPorts,
+	}
+	if settings.Container != nil {
+		conf.container = *settings.Container
+	}
+	if profile != nil {
+		conf.container = profile.applyTo(conf.container)
+	}
+	telegrafConf, conf.env, err = secretRefsToEnv(telegrafConf)
+	if err != nil {
+		return nil, err
+	}
+	// secrets referenced by the class are trusted, while ones referenced by the pod, such as in its inputs,
+	// are subject to the policy
+	classSecretRefs := secretRefEnvNames(classData)
+	for _, env := range conf.env {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && !classSecretRefs[env.Name] {
+			if conf.podSecretRefs == nil {
+				conf.podSecretRefs = map[string]string{}
+			}
+			conf.podSecretRefs[env.Name] = env.ValueFrom.SecretKeyRef.Name
+		}
+	}
+
+	var secretStoresConf string
+	secretStoresConf, conf.secretStores, err = secretStores(telegrafConf, settings.SecretStores)
+	if err != nil {
+		return nil, err
+	}
+	telegrafConf = fmt.Sprintf("%s%s", telegrafConf, secretStoresConf)
+
+	conf.serviceAccountToken, err = serviceAccountToken(pod, settings)
+	if err != nil {
+		return nil, err
+	}
+	if conf.serviceAccountToken != nil {
+		conf.env = append(conf.env, corev1.EnvVar{
+			Name:  serviceAccountTokenEnv,
+			Value: path.Join(serviceAccountTokenPath, serviceAccountTokenFile),
+		})
+	}
+
+	conf.clientCertificate, err = h.clientCertificateSubject(pod, settings)
+	if err != nil {
+		return nil, err
+	}
+
 	if _, err := toml.Parse([]byte(telegrafConf)); err != nil {
-		return "", fmt.Errorf("resulting Telegraf is not a valid file: %v", err)
+		return nil, fmt.Errorf("resulting Telegraf is not a valid file: %v", err)
 	}
+	conf.telegrafConf = telegrafConf
 
-	return telegrafConf, err
+	return conf, nil
+}
+
+// tomlKey returns the key as is if it is a valid bare TOML key, or quoted otherwise.
+func tomlKey(key string) string {
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return fmt.Sprintf("%q", key)
+		}
+	}
+	return key
 }
 
 func (h *sidecarHandler) newSecret(pod *corev1.Pod, className, name, namespace, containerName, telegrafConf string) (*corev1.Secret, error) {
@@ -374,8 +775,16 @@ func (h *sidecarHandler) newVolume(name, containerName string) corev1.Volume {
 	}
 }
 
+// resolveImage returns the image to use for a sidecar container, using the image resolver if one is configured.
+func (h *sidecarHandler) resolveImage(image string) (string, error) {
+	if h.ImageResolver == nil {
+		return image, nil
+	}
+	return h.ImageResolver.resolve(image)
+}
+
 // parseCustomOrDefaultQuantity parses custom quantity from annotations, storing it in provided ResourceList as resourceName,
-// defaulting to quantity specified to the handler if the custom one is not valid
+// defaulting to the class, resources profile or handler quantity passed as defaultQuantity if the custom one is not valid
 func (h *sidecarHandler) parseCustomOrDefaultQuantity(result corev1.ResourceList, resourceName corev1.ResourceName, customQuantity string, defaultQuantity string) (err error) {
 	// if default or current value is an empty string, do not set value
 	if customQuantity == "" {
@@ -412,39 +821,24 @@ func (h *sidecarHandler) parseCustomTelegrafVolumeMounts(volumeMounts *map[strin
 	return nil
 }
 
-func (h *sidecarHandler) newContainer(pod *corev1.Pod, containerName string) (corev1.Container, error) {
-	var telegrafImage string
-	var telegrafRequestsCPU string
-	var telegrafRequestsMemory string
-	var telegrafLimitsCPU string
-	var telegrafLimitsMemory string
+func (h *sidecarHandler) newContainer(pod *corev1.Pod, containerName string, conf *sidecarConf) (corev1.Container, error) {
 	var telegrafVolumeMounts string
 
-	if customTelegrafImage, ok := pod.Annotations[TelegrafImage]; ok {
-		telegrafImage = customTelegrafImage
-	} else {
-		telegrafImage = h.TelegrafImage
-	}
-	if customTelegrafRequestsCPU, ok := pod.Annotations[TelegrafRequestsCPU]; ok {
-		telegrafRequestsCPU = customTelegrafRequestsCPU
-	} else {
-		telegrafRequestsCPU = h.RequestsCPU
-	}
-	if customTelegrafRequestsMemory, ok := pod.Annotations[TelegrafRequestsMemory]; ok {
-		telegrafRequestsMemory = customTelegrafRequestsMemory
-	} else {
-		telegrafRequestsMemory = h.RequestsMemory
+	// pod annotations take precedence over the resources profile and container settings of the class,
+	// which take precedence over operator defaults
+	telegrafImage := customOrClassValue(pod, TelegrafImage, conf.container.Image, h.TelegrafImage)
+	telegrafRequestsCPU := customOrClassValue(pod, TelegrafRequestsCPU, conf.container.RequestsCPU, h.RequestsCPU)
+	telegrafRequestsMemory := customOrClassValue(pod, TelegrafRequestsMemory, conf.container.RequestsMemory, h.RequestsMemory)
+	telegrafLimitsCPU := customOrClassValue(pod, TelegrafLimitsCPU, conf.container.LimitsCPU, h.LimitsCPU)
+	telegrafLimitsMemory := customOrClassValue(pod, TelegrafLimitsMemory, conf.container.LimitsMemory, h.LimitsMemory)
+	telegrafWatchConfig := h.TelegrafWatchConfig
+	if conf.container.WatchConfig != "" {
+		telegrafWatchConfig = conf.container.WatchConfig
 	}
-	if customTelegrafLimitsCPU, ok := pod.Annotations[TelegrafLimitsCPU]; ok {
-		telegrafLimitsCPU = customTelegrafLimitsCPU
-	} else {
-		telegrafLimitsCPU = h.LimitsCPU
-	}
-	if customTelegrafLimitsMemory, ok := pod.Annotations[TelegrafLimitsMemory]; ok {
-		telegrafLimitsMemory = customTelegrafLimitsMemory
-	} else {
-		telegrafLimitsMemory = h.LimitsMemory
+	if telegrafWatchConfig == "" && conf.clientCertificate != nil {
+		telegrafWatchConfig = clientCertificateWatchConfig
 	}
+
 	if customeTelegrafVolumeMounts, ok := pod.Annotations[TelegrafVolumeMounts]; ok {
 		telegrafVolumeMounts = customeTelegrafVolumeMounts
 	} else {
@@ -455,24 +849,30 @@ func (h *sidecarHandler) newContainer(pod *corev1.Pod, containerName string) (co
 	resourceLimits := corev1.ResourceList{}
 	volumeMounts := map[string]string{}
 
-	if err := h.parseCustomOrDefaultQuantity(resourceRequests, "cpu", telegrafRequestsCPU, h.RequestsCPU); err != nil {
+	if err := h.parseCustomOrDefaultQuantity(resourceRequests, "cpu", telegrafRequestsCPU, classOrDefaultValue(conf.container.RequestsCPU, h.RequestsCPU)); err != nil {
 		return corev1.Container{}, err
 	}
-	if err := h.parseCustomOrDefaultQuantity(resourceRequests, "memory", telegrafRequestsMemory, h.RequestsMemory); err != nil {
+	if err := h.parseCustomOrDefaultQuantity(resourceRequests, "memory", telegrafRequestsMemory, classOrDefaultValue(conf.container.RequestsMemory, h.RequestsMemory)); err != nil {
 		return corev1.Container{}, err
 	}
 
-	if err := h.parseCustomOrDefaultQuantity(resourceLimits, "cpu", telegrafLimitsCPU, h.LimitsCPU); err != nil {
+	if err := h.parseCustomOrDefaultQuantity(resourceLimits, "cpu", telegrafLimitsCPU, classOrDefaultValue(conf.container.LimitsCPU, h.LimitsCPU)); err != nil {
 		return corev1.Container{}, err
 	}
-	if err := h.parseCustomOrDefaultQuantity(resourceLimits, "memory", telegrafLimitsMemory, h.LimitsMemory); err != nil {
+	if err := h.parseCustomOrDefaultQuantity(resourceLimits, "memory", telegrafLimitsMemory, classOrDefaultValue(conf.container.LimitsMemory, h.LimitsMemory)); err != nil {
 		return corev1.Container{}, err
 	}
 	if err := h.parseCustomTelegrafVolumeMounts(&volumeMounts, telegrafVolumeMounts); err != nil {
 		return corev1.Container{}, err
 	}
+	addBufferMemory(resourceLimits, conf.buffer)
+
+	telegrafImage, err := h.resolveImage(telegrafImage)
+	if err != nil {
+		return corev1.Container{}, err
+	}
 
-	telegrafContainerCommand := createTelegrafCommand(h.TelegrafWatchConfig)
+	telegrafContainerCommand := createTelegrafCommand(telegrafWatchConfig)
 
 	baseContainer := corev1.Container{
 		Name:    containerName,
@@ -482,16 +882,9 @@ func (h *sidecarHandler) newContainer(pod *corev1.Pod, containerName string) (co
 			Requests: resourceRequests,
 			Limits:   resourceLimits,
 		},
-		Env: []corev1.EnvVar{
-			{
-				Name: "NODENAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "spec.nodeName",
-					},
-				},
-			},
-		},
+		Env:             h.downwardAPIEnv(pod),
+		Ports:           conf.ports(),
+		SecurityContext: conf.securityContext(),
 
 		VolumeMounts: []corev1.VolumeMount{
 			{
@@ -508,7 +901,8 @@ func (h *sidecarHandler) newContainer(pod *corev1.Pod, containerName string) (co
 			MountPath: mountPath,
 		})
 	}
-	baseContainer.VolumeMounts = vls
+	baseContainer.VolumeMounts = append(vls, conf.volumeMounts(containerName)...)
+	baseContainer.Env = append(baseContainer.Env, conf.env...)
 
 	if secretEnv, ok := pod.Annotations[TelegrafSecretEnv]; ok {
 		baseContainer.EnvFrom = []corev1.EnvFromSource{
@@ -582,6 +976,13 @@ func (h *sidecarHandler) newContainer(pod *corev1.Pod, containerName string) (co
 			h.Logger.Info("unable to parse secretkeyref %s with value of \"%s\"", name, value)
 		}
 	}
+
+	// environment variables of the class are only added if they are not set by the pod or telegraf-operator
+	for _, env := range conf.container.env() {
+		if !containerHasEnv(baseContainer, env.Name) {
+			baseContainer.Env = append(baseContainer.Env, env)
+		}
+	}
 	return baseContainer, nil
 }
 
@@ -595,7 +996,7 @@ func AnnotationsWithPrefix(annotations map[string]string, prefix string) map[str
 	return filtered
 }
 
-func (h *sidecarHandler) newIstioContainer(pod *corev1.Pod, containerName string) (corev1.Container, error) {
+func (h *sidecarHandler) newIstioContainer(pod *corev1.Pod, containerName string, conf *sidecarConf) (corev1.Container, error) {
 
 	var istioTelegrafRequestsCPU string
 	var istioTelegrafRequestsMemory string
@@ -645,6 +1046,11 @@ func (h *sidecarHandler) newIstioContainer(pod *corev1.Pod, containerName string
 		telegrafImage = h.TelegrafImage
 	}
 
+	telegrafImage, err := h.resolveImage(telegrafImage)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
 	telegrafContainerCommand := createTelegrafCommand(h.IstioTelegrafWatchConfig)
 
 	baseContainer := corev1.Container{
@@ -655,16 +1061,7 @@ func (h *sidecarHandler) newIstioContainer(pod *corev1.Pod, containerName string
 			Requests: resourceRequests,
 			Limits:   resourceLimits,
 		},
-		Env: []corev1.EnvVar{
-			{
-				Name: "NODENAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "spec.nodeName",
-					},
-				},
-			},
-		},
+		Env: h.downwardAPIEnv(pod),
 
 		VolumeMounts: []corev1.VolumeMount{
 			{
@@ -673,6 +1070,8 @@ func (h *sidecarHandler) newIstioContainer(pod *corev1.Pod, containerName string
 			},
 		},
 	}
+	baseContainer.VolumeMounts = append(baseContainer.VolumeMounts, conf.volumeMounts(containerName)...)
+	baseContainer.Env = append(baseContainer.Env, conf.env...)
 
 	return baseContainer, nil
 }
@@ -700,6 +1099,131 @@ func ports(pod *corev1.Pod) []string {
 	return ps
 }
 
+// scrapeHostSetting returns the scrape host setting for the pod, as specified by annotation or the operator default.
+func (h *sidecarHandler) scrapeHostSetting(pod *corev1.Pod) string {
+	if host, ok := pod.Annotations[TelegrafScrapeHost]; ok {
+		return strings.TrimSpace(host)
+	}
+	return h.ScrapeHost
+}
+
+// scrapeHost returns the host to use in URLs for scraping metrics, adding brackets to IPv6 addresses;
+// the pod's own IP address is passed using environment variable, which telegraf substitutes in its configuration.
+func (h *sidecarHandler) scrapeHost(pod *corev1.Pod) (string, error) {
+	host := h.scrapeHostSetting(pod)
+	if err := validateScrapeHost(host); err != nil {
+		return "", err
+	}
+	switch host {
+	case "":
+		return "127.0.0.1", nil
+	case ScrapeHostPodIP:
+		return fmt.Sprintf("${%s}", podIPEnv), nil
+	case ScrapeHostPodIPv6:
+		return fmt.Sprintf("[${%s}]", podIPEnv), nil
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("[%s]", host), nil
+	}
+	return host, nil
+}
+
+// validateScrapeHost checks that the scrape host is pod-ip, pod-ipv6, an IP address, optionally in brackets,
+// or a hostname, so that it can be safely used in URLs.
+func validateScrapeHost(host string) error {
+	switch host {
+	case "", ScrapeHostPodIP, ScrapeHostPodIPv6:
+		return nil
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		if ip := net.ParseIP(host[1 : len(host)-1]); ip != nil {
+			return nil
+		}
+	} else if net.ParseIP(host) != nil || len(validation.IsDNS1123Subdomain(host)) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid scrape host %q, expected %s, %s, an IP address or a hostname", host, ScrapeHostPodIP, ScrapeHostPodIPv6)
+}
+
+// scrapesPodIP checks whether the sidecar scrapes the pod's IP address, which requires passing it as environment variable.
+func (h *sidecarHandler) scrapesPodIP(pod *corev1.Pod) bool {
+	host := h.scrapeHostSetting(pod)
+	return host == ScrapeHostPodIP || host == ScrapeHostPodIPv6
+}
+
+// parseNamepass checks that namepass specified as raw TOML is an array of strings, returning its TOML source,
+// so that the annotation can not add any other settings or tables to the configuration.
+func parseNamepass(namepassRaw string) (string, error) {
+	tbl, err := toml.Parse([]byte(fmt.Sprintf("namepass = %s", namepassRaw)))
+	if err != nil {
+		return "", err
+	}
+	if len(tbl.Fields) != 1 {
+		return "", fmt.Errorf("namepass must be an array of strings, %s given", namepassRaw)
+	}
+	kv, ok := tbl.Fields["namepass"].(*ast.KeyValue)
+	if !ok {
+		return "", fmt.Errorf("namepass must be an array of strings, %s given", namepassRaw)
+	}
+	array, ok := kv.Value.(*ast.Array)
+	if !ok {
+		return "", fmt.Errorf("namepass must be an array of strings, %s given", namepassRaw)
+	}
+	for _, value := range array.Value {
+		if _, ok := value.(*ast.String); !ok {
+			return "", fmt.Errorf("namepass must be an array of strings, %s given", namepassRaw)
+		}
+	}
+	return array.Source(), nil
+}
+
+// resolvePorts resolves all ports using resolvePort, returning sorted list of unique port numbers.
+func resolvePorts(pod *corev1.Pod, ports []string) ([]string, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+
+	uniquePorts := map[string]struct{}{}
+	for _, p := range ports {
+		port, err := resolvePort(pod, p)
+		if err != nil {
+			return nil, err
+		}
+		uniquePorts[port] = struct{}{}
+	}
+
+	ps := make([]string, 0, len(uniquePorts))
+	for p := range uniquePorts {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	return ps, nil
+}
+
+// resolvePort returns the port number for a port specified either as a number or as a name of one
+// of the pod's container ports, returning an error if the port is out of range or not found.
+func resolvePort(pod *corev1.Pod, port string) (string, error) {
+	port = strings.TrimSpace(port)
+	if number, err := strconv.ParseInt(port, 10, 0); err == nil {
+		if number < 1 || number > 65535 {
+			return "", fmt.Errorf("port %s is out of range", port)
+		}
+		return strconv.FormatInt(number, 10), nil
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			if containerPort.Name == port {
+				return strconv.Itoa(int(containerPort.ContainerPort)), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("port %q is not a number or a name of any container port", port)
+}
+
 func podHasContainerName(pod *corev1.Pod, name string) bool {
 	for _, container := range pod.Spec.Containers {
 		if container.Name == name {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// sidecarConf is telegraf configuration assembled for a sidecar, along with what the sidecar container needs
+// for the configuration to work.
+type sidecarConf struct {
+	telegrafConf string
+	// rawInputs are inputs configured for the pod using annotations or ConfigMaps
+	rawInputs string
+	// rawProcessors and rawAggregators are processors and aggregators configured for the pod using annotations
+	rawProcessors  string
+	rawAggregators string
+	// inputsConfigMap is the reference to the ConfigMap key with inputs for the pod, if any
+	inputsConfigMap string
+	// logs lists settings of log collection for application containers, by container name
+	logs map[string]logsSettings
+	// listeners lists input plugins listening for metrics pushed by application containers
+	listeners []listener
+	// procstat lists patterns of processes to monitor in application containers, by container name
+	procstat map[string]string
+	// buffer is the volume for buffering metrics on disk, if any
+	buffer *corev1.EmptyDirVolumeSource
+	// prometheusClient describes how metrics are exposed for prometheus to scrape, if enabled
+	prometheusClient *prometheusClientSettings
+	// scrapedPorts lists ports of the pod that telegraf scrapes using the prometheus input
+	scrapedPorts []string
+	// container lists settings of the sidecar container configured for the class and the resources profile
+	container containerSettings
+	// env lists environment variables referenced by the configuration
+	env []corev1.EnvVar
+	// podSecretRefs maps names of environment variables in env to names of secrets referenced by the pod,
+	// such as in its inputs, rather than by the class
+	podSecretRefs map[string]string
+	// secretStores lists keys of secrets that should be available to secret stores in the configuration
+	secretStores []corev1.VolumeProjection
+	// serviceAccountToken is the projected service account token to mount, if any
+	serviceAccountToken *corev1.ServiceAccountTokenProjection
+	// clientCertificate is the subject of the client certificate to issue, if any
+	clientCertificate *pkix.Name
+}
+
+// volumes returns additional volumes that should be added to the pod for the sidecar container.
+func (c *sidecarConf) volumes(containerName string) []corev1.Volume {
+	var volumes []corev1.Volume
+	if len(c.secretStores) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: fmt.Sprintf("%s-secretstores", containerName),
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					Sources: c.secretStores,
+				},
+			},
+		})
+	}
+	if c.serviceAccountToken != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: fmt.Sprintf("%s-serviceaccount", containerName),
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{ServiceAccountToken: c.serviceAccountToken}},
+				},
+			},
+		})
+	}
+	if len(c.logs) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: logsVolumeName(containerName),
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+	if c.buffer != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: fmt.Sprintf("%s-buffer", containerName),
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: c.buffer,
+			},
+		})
+	}
+	return volumes
+}
+
+// volumeMounts returns additional volume mounts for the sidecar container.
+func (c *sidecarConf) volumeMounts(containerName string) []corev1.VolumeMount {
+	var volumeMounts []corev1.VolumeMount
+	if len(c.secretStores) > 0 {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      fmt.Sprintf("%s-secretstores", containerName),
+			MountPath: secretStoresPath,
+			ReadOnly:  true,
+		})
+	}
+	if c.serviceAccountToken != nil {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      fmt.Sprintf("%s-serviceaccount", containerName),
+			MountPath: serviceAccountTokenPath,
+			ReadOnly:  true,
+		})
+	}
+	if len(c.logs) > 0 {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      logsVolumeName(containerName),
+			MountPath: logsPath,
+			ReadOnly:  true,
+		})
+	}
+	if c.buffer != nil {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      fmt.Sprintf("%s-buffer", containerName),
+			MountPath: bufferPath,
+		})
+	}
+	return volumeMounts
+}
+
+// ports returns container ports of the sidecar container.
+func (c *sidecarConf) ports() []corev1.ContainerPort {
+	ports := listenersPorts(c.listeners)
+	if c.prometheusClient != nil {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          prometheusClientPortName,
+			ContainerPort: int32(c.prometheusClient.Port),
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+	return ports
+}
+
+// securityContext returns the security context of the sidecar container, if it needs one.
+func (c *sidecarConf) securityContext() *corev1.SecurityContext {
+	if len(c.procstat) == 0 {
+		return nil
+	}
+	return &corev1.SecurityContext{
+		Capabilities: &corev1.Capabilities{
+			Add: []corev1.Capability{procstatCapability},
+		},
+	}
+}
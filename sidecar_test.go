@@ -7,11 +7,14 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr/testr"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	testclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
 
 	"github.com/kudobuilder/kuttl/pkg/test/utils"
 )
@@ -265,6 +268,86 @@ func Test_assembleConf(t *testing.T) {
   urls = ["http://127.0.0.1:6060/metrics"]
   metric_version = 2
 
+`,
+		},
+		{
+			name: "prometheus settings with scrape targets",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPort:   "6060",
+						TelegrafScrapeTargets: `[{"port": 9443, "scheme": "https", "path": "/admin/metrics"}]`,
+					},
+				},
+			},
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:6060/metrics"]
+
+
+[[inputs.prometheus]]
+  urls = ["https://127.0.0.1:9443/admin/metrics"]
+`,
+		},
+		{
+			name: "named ports are resolved from container ports",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPorts:  "http-metrics",
+						TelegrafScrapeTargets: `[{"port": "admin-metrics"}]`,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "app",
+							Ports: []corev1.ContainerPort{
+								{Name: "http-metrics", ContainerPort: 8080},
+								{Name: "admin-metrics", ContainerPort: 9443},
+							},
+						},
+					},
+				},
+			},
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:8080/metrics"]
+
+
+[[inputs.prometheus]]
+  urls = ["http://127.0.0.1:9443/metrics"]
+`,
+		},
+		{
+			name: "unknown named port",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPorts: "http-metrics",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "prometheus settings with IPv6 scrape host",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPort:   "6060",
+						TelegrafScrapeHost:    "::1",
+						TelegrafScrapeTargets: `[{"port": 9443}]`,
+					},
+				},
+			},
+			wantConfig: `
+[[inputs.prometheus]]
+  urls = ["http://[::1]:6060/metrics"]
+
+
+[[inputs.prometheus]]
+  urls = ["http://[::1]:9443/metrics"]
 `,
 		},
 		{
@@ -407,6 +490,24 @@ func Test_assembleConf(t *testing.T) {
 }
 
 func Test_addSidecars(t *testing.T) {
+	profiles := map[string]*resourcesProfile{
+		"large": {
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("256Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+			MetricBufferLimit: 100000,
+		},
+		"small": {
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+	}
+
 	tests := []struct {
 		name                        string
 		pod                         *corev1.Pod
@@ -415,8 +516,15 @@ func Test_addSidecars(t *testing.T) {
 		telegrafWatchConfig         string
 		istioTelegrafImage          string
 		istioOutputClass            string
+		classes                     map[string]string
+		clientCertificate           bool
+		resourcesProfiles           map[string]*resourcesProfile
+		imageResolver               *imageResolver
+		enableScrapeDiscovery       bool
+		scrapeDiscoveryPortNames    []string
 		wantSecrets                 []string
 		wantPod                     string
+		wantErr                     string
 	}{
 		{
 			name: "validate prometheus inputs creation",
@@ -1529,119 +1637,1937 @@ status: {}
       `,
 			wantSecrets: []string{testEmptySecret},
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			dir := createTempClassesDirectory(t, map[string]string{
-				"default": "",
-				"istio":   "# istio outputs",
-			})
-			defer os.RemoveAll(dir)
-
-			logger := testr.New(t)
-
-			testClassDataHandler := &directoryClassDataHandler{
-				Logger:                   logger,
-				TelegrafClassesDirectory: dir,
-			}
-
-			handler := &sidecarHandler{
-				ClassDataHandler:            testClassDataHandler,
-				TelegrafDefaultClass:        "default",
-				TelegrafImage:               defaultTelegrafImage,
-				TelegrafWatchConfig:         tt.telegrafWatchConfig,
-				EnableDefaultInternalPlugin: tt.enableDefaultInternalPlugin,
-				EnableIstioInjection:        tt.enableIstioInjection,
-				IstioOutputClass:            tt.istioOutputClass,
-				IstioTelegrafImage:          tt.istioTelegrafImage,
-				RequestsCPU:                 defaultRequestsCPU,
-				RequestsMemory:              defaultRequestsMemory,
-				LimitsCPU:                   defaultLimitsCPU,
-				LimitsMemory:                defaultLimitsMemory,
-				IstioRequestsCPU:            defaultRequestsCPU,
-				IstioRequestsMemory:         defaultRequestsMemory,
-				IstioLimitsCPU:              defaultLimitsCPU,
-				IstioLimitsMemory:           defaultLimitsMemory,
-				Logger:                      testr.New(t),
-			}
-
-			result, err := handler.addSidecars(tt.pod, "myname", "mynamespace")
-			if err != nil {
-				t.Errorf("unexpected error adding to sidecar: %v", err)
-			}
-
-			if want, got := len(tt.wantSecrets), len(result.secrets); got != want {
-				t.Errorf("invalid number of secrets returned got: %d; want: %d", got, want)
-			}
-			for i := 0; i < len(result.secrets); i++ {
-				if want, got := strings.TrimSpace(tt.wantSecrets[i]), strings.TrimSpace(toYAML(t, result.secrets[i])); got != want {
-					t.Errorf("unexpected secret %d got:\n%v\nwant:\n%v", i, got, want)
-				}
-			}
-
-			if tt.wantPod != "" {
-				if want, got := strings.TrimSpace(tt.wantPod), strings.TrimSpace(toYAML(t, tt.pod)); got != want {
-					t.Errorf("unexpected pod got:\n%v\nwant:\n%v", got, want)
-				}
-			}
-		})
-	}
-}
-
-func Test_ports(t *testing.T) {
-	tests := []struct {
-		name string
-		pod  *corev1.Pod
-		want []string
-	}{
 		{
-			name: "ports merges ports for both annotations",
+			name: "secret stores of the class",
 			pod: &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
 					Annotations: map[string]string{
-						TelegrafMetricsPort:  "6060",
-						TelegrafMetricsPorts: "6060,8080,8888",
+						TelegrafClass: "secretstores",
 					},
 				},
 			},
-			want: []string{"6060", "8080", "8888"},
-		},
-		{
-			name: "no annotation returns no ports",
-			pod: &corev1.Pod{
-				ObjectMeta: metav1.ObjectMeta{
-					Annotations: map[string]string{},
-				},
+			classes: map[string]string{
+				"secretstores": `[[outputs.influxdb_v2]]
+  token = "@{influxdb:token}"
+
+[telegraf_operator.secretstores]
+  influxdb = "influxdb-auth"
+`,
 			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: secretstores
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+    - mountPath: /run/secrets
+      name: telegraf-secretstores
+      readOnly: true
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+  - name: telegraf-secretstores
+    projected:
+      sources:
+      - secret:
+          items:
+          - key: token
+            path: token
+          name: influxdb-auth
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: secretstores
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+    [[outputs.influxdb_v2]]
+      token = "@{influxdb:token}"
+
+
+
+    [[secretstores.docker]]
+      id = "influxdb"
+type: Opaque`},
 		},
 		{
-			name: "ports are unique and returned in order",
+			name: "service account token of the class",
 			pod: &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
 					Annotations: map[string]string{
-						TelegrafMetricsPorts: "8086,6060,6060",
+						TelegrafClass:       "gateway",
+						TelegrafMetricsPort: "6060",
 					},
 				},
 			},
-			want: []string{"6060", "8086"},
+			classes: map[string]string{
+				"gateway": `[[outputs.http]]
+  url = "http://gateway:8080"
+
+[telegraf_operator.service_account_token]
+  audience = "gateway"
+`,
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: gateway
+    telegraf.influxdata.com/port: "6060"
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    - name: SERVICE_ACCOUNT_TOKEN_FILE
+      value: /var/run/telegraf/serviceaccount/token
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+    - mountPath: /var/run/telegraf/serviceaccount
+      name: telegraf-serviceaccount
+      readOnly: true
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+  - name: telegraf-serviceaccount
+    projected:
+      sources:
+      - serviceAccountToken:
+          audience: gateway
+          expirationSeconds: 3600
+          path: token
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: gateway
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [[inputs.prometheus]]
+      urls = ["http://127.0.0.1:6060/metrics"]
+
+
+    [[outputs.http]]
+      url = "http://gateway:8080"
+
+
+type: Opaque`},
 		},
 		{
-			name: "single port from TelegrafMetricsPorts",
+			name: "client certificate of the class",
 			pod: &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
+					Name: "myname",
 					Annotations: map[string]string{
-						TelegrafMetricsPorts: "6060",
+						TelegrafClass:       "clientcert",
+						TelegrafMetricsPort: "6060",
 					},
 				},
 			},
-			want: []string{"6060"},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := ports(tt.pod); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("ports() = %v, want %v", got, tt.want)
+			classes: map[string]string{
+				"clientcert": `[[outputs.influxdb_v2]]
+  tls_cert = "/etc/telegraf/tls.crt"
+  tls_key = "/etc/telegraf/tls.key"
+
+[telegraf_operator]
+  client_certificate = "workload"
+`,
+			},
+			clientCertificate: true,
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: clientcert
+    telegraf.influxdata.com/port: "6060"
+  creationTimestamp: null
+  name: myname
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    - --watch-config
+    - inotify
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: clientcert
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  ca.crt: CERTIFICATE subject=CN=test-ca issuer=CN=test-ca
+  telegraf.conf: |2+
+
+    [[inputs.prometheus]]
+      urls = ["http://127.0.0.1:6060/metrics"]
+
+
+    [[outputs.influxdb_v2]]
+      tls_cert = "/etc/telegraf/tls.crt"
+      tls_key = "/etc/telegraf/tls.key"
+
+
+  tls.crt: CERTIFICATE subject=CN=myname,O=mynamespace issuer=CN=test-ca
+  tls.key: EC PRIVATE KEY
+type: Opaque`},
+		},
+		{
+			name: "logs of the application containers",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafLogs: `{"app": {"path": "/var/log/app", "format": "logfmt"}}`,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app"}, {Name: "other"}},
+				},
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/logs: '{"app": {"path": "/var/log/app", "format": "logfmt"}}'
+  creationTimestamp: null
+spec:
+  containers:
+  - name: app
+    resources: {}
+    volumeMounts:
+    - mountPath: /var/log/app
+      name: telegraf-logs
+      subPath: app
+  - name: other
+    resources: {}
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+    - mountPath: /var/run/telegraf/logs
+      name: telegraf-logs
+      readOnly: true
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+  - emptyDir: {}
+    name: telegraf-logs
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: default
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [[inputs.tail]]
+      files = ["/var/run/telegraf/logs/app/*.log"]
+      data_format = "logfmt"
+      [inputs.tail.tags]
+        container_name = "app"
+
+type: Opaque`},
+		},
+		{
+			name: "listeners for the application containers",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafListeners: "statsd,opentelemetry",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Env: []corev1.EnvVar{{Name: "STATSD_HOST", Value: "statsd.monitoring"}}},
+					},
+				},
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/listeners: statsd,opentelemetry
+  creationTimestamp: null
+spec:
+  containers:
+  - env:
+    - name: STATSD_HOST
+      value: statsd.monitoring
+    - name: OTEL_EXPORTER_OTLP_ENDPOINT
+      value: http://localhost:4317
+    - name: OTEL_EXPORTER_OTLP_PROTOCOL
+      value: grpc
+    - name: STATSD_PORT
+      value: "8125"
+    name: app
+    resources: {}
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    ports:
+    - containerPort: 4317
+      name: otlp-grpc
+      protocol: TCP
+    - containerPort: 8125
+      name: statsd
+      protocol: UDP
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: default
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [[inputs.opentelemetry]]
+      service_address = ":4317"
+    [[inputs.statsd]]
+      protocol = "udp"
+      service_address = ":8125"
+
+type: Opaque`},
+		},
+		{
+			name: "procstat of the application containers",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafProcstat: `{"app": "nginx"}`,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app"}},
+				},
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/procstat: '{"app": "nginx"}'
+  creationTimestamp: null
+spec:
+  containers:
+  - name: app
+    resources: {}
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    securityContext:
+      capabilities:
+        add:
+        - SYS_PTRACE
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  shareProcessNamespace: true
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: default
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [[inputs.procstat]]
+      pattern = "nginx"
+      pid_finder = "native"
+      [inputs.procstat.tags]
+        container_name = "app"
+
+type: Opaque`},
+		},
+		{
+			name: "buffer of the class on disk",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass: "buffer-disk",
+						TelegrafAgent: `flush_interval = "30s"`,
+					},
+				},
+			},
+			classes: map[string]string{
+				"buffer-disk": `[agent]
+  interval = "10s"
+
+[telegraf_operator.buffer]
+  size_limit = "64Mi"
+  medium = "disk"
+`,
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/agent: flush_interval = "30s"
+    telegraf.influxdata.com/class: buffer-disk
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+    - mountPath: /var/run/telegraf/buffer
+      name: telegraf-buffer
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+  - emptyDir:
+      sizeLimit: 64Mi
+    name: telegraf-buffer
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: buffer-disk
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+
+
+
+
+    [agent]
+      buffer_directory = "/var/run/telegraf/buffer"
+      buffer_strategy = "disk"
+      flush_interval = "30s"
+      interval = "10s"
+type: Opaque`},
+		},
+		{
+			name: "buffer of the class on memory",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass: "buffer-memory",
+						TelegrafAgent: `flush_interval = "30s"`,
+					},
+				},
+			},
+			classes: map[string]string{
+				"buffer-memory": `[agent]
+  interval = "10s"
+
+[telegraf_operator.buffer]
+  size_limit = "64Mi"
+  medium = "memory"
+`,
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/agent: flush_interval = "30s"
+    telegraf.influxdata.com/class: buffer-memory
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 264Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+    - mountPath: /var/run/telegraf/buffer
+      name: telegraf-buffer
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+  - emptyDir:
+      medium: Memory
+      sizeLimit: 64Mi
+    name: telegraf-buffer
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: buffer-memory
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+
+
+
+
+    [agent]
+      buffer_directory = "/var/run/telegraf/buffer"
+      buffer_strategy = "disk"
+      flush_interval = "30s"
+      interval = "10s"
+type: Opaque`},
+		},
+		{
+			name: "container settings of the operator",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass: "app",
+					},
+				},
+			},
+			telegrafWatchConfig: "inotify",
+			classes: map[string]string{
+				"app": "",
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: app
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    - --watch-config
+    - inotify
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: app
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+type: Opaque`},
+		},
+		{
+			name: "container settings of the class take precedence over the operator",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass: "infra",
+					},
+				},
+			},
+			telegrafWatchConfig: "inotify",
+			classes: map[string]string{
+				"infra": `[telegraf_operator.container]
+  image = "docker.io/library/telegraf:1.30"
+  requests_cpu = "100m"
+  limits_memory = "1Gi"
+  watch_config = "poll"
+  [telegraf_operator.container.env]
+    INFLUX_BUCKET = "infra"
+    NODENAME = "ignored"
+`,
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: infra
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    - --watch-config
+    - poll
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    - name: INFLUX_BUCKET
+      value: infra
+    image: docker.io/library/telegraf:1.30
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 1Gi
+      requests:
+        cpu: 100m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: infra
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+
+
+type: Opaque`},
+		},
+		{
+			name: "container settings of the pod take precedence over the class",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:        "infra",
+						TelegrafImage:        "docker.io/library/telegraf:1.31",
+						TelegrafLimitsMemory: "2Gi",
+						TelegrafEnvLiteralPrefix + "INFLUX_BUCKET": "team",
+					},
+				},
+			},
+			telegrafWatchConfig: "inotify",
+			classes: map[string]string{
+				"infra": `[telegraf_operator.container]
+  image = "docker.io/library/telegraf:1.30"
+  requests_cpu = "100m"
+  limits_memory = "1Gi"
+  watch_config = "poll"
+  [telegraf_operator.container.env]
+    INFLUX_BUCKET = "infra"
+    NODENAME = "ignored"
+`,
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: infra
+    telegraf.influxdata.com/env-literal-INFLUX_BUCKET: team
+    telegraf.influxdata.com/image: docker.io/library/telegraf:1.31
+    telegraf.influxdata.com/limits-memory: 2Gi
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    - --watch-config
+    - poll
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    - name: INFLUX_BUCKET
+      value: team
+    image: docker.io/library/telegraf:1.31
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 2Gi
+      requests:
+        cpu: 100m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: infra
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+
+
+type: Opaque`},
+		},
+		{
+			name: "resources of the class without profile",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass: "profiles",
+					},
+				},
+			},
+			classes: map[string]string{
+				"profiles": `[agent]
+  flush_interval = "30s"
+
+[telegraf_operator.container]
+  requests_cpu = "50m"
+  limits_memory = "128Mi"
+`,
+			},
+			resourcesProfiles: profiles,
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: profiles
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 128Mi
+      requests:
+        cpu: 50m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [agent]
+      flush_interval = "30s"
+
+
+type: Opaque`},
+		},
+		{
+			name: "resources profile takes precedence over the class",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:            "profiles",
+						TelegrafResourcesProfile: "large",
+					},
+				},
+			},
+			classes: map[string]string{
+				"profiles": `[agent]
+  flush_interval = "30s"
+
+[telegraf_operator.container]
+  requests_cpu = "50m"
+  limits_memory = "128Mi"
+`,
+			},
+			resourcesProfiles: profiles,
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/resources-profile: large
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 512Mi
+      requests:
+        cpu: 100m
+        memory: 256Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+
+
+
+    [agent]
+      flush_interval = "30s"
+      metric_buffer_limit = 100000
+type: Opaque`},
+		},
+		{
+			name: "resources of the pod take precedence over the profile",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:            "profiles",
+						TelegrafResourcesProfile: "large",
+						TelegrafLimitsMemory:     "1Gi",
+						TelegrafAgent:            "metric_buffer_limit = 5000",
+					},
+				},
+			},
+			classes: map[string]string{
+				"profiles": `[agent]
+  flush_interval = "30s"
+
+[telegraf_operator.container]
+  requests_cpu = "50m"
+  limits_memory = "128Mi"
+`,
+			},
+			resourcesProfiles: profiles,
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/agent: metric_buffer_limit = 5000
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/limits-memory: 1Gi
+    telegraf.influxdata.com/resources-profile: large
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 1Gi
+      requests:
+        cpu: 100m
+        memory: 256Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+
+
+
+
+    [agent]
+      flush_interval = "30s"
+      metric_buffer_limit = 5000
+type: Opaque`},
+		},
+		{
+			name: "invalid resources of the pod fall back to the profile",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:            "profiles",
+						TelegrafResourcesProfile: "large",
+						TelegrafRequestsCPU:      "1 core",
+						TelegrafLimitsMemory:     "1 GB",
+					},
+				},
+			},
+			classes: map[string]string{
+				"profiles": `[agent]
+  flush_interval = "30s"
+
+[telegraf_operator.container]
+  requests_cpu = "50m"
+  limits_memory = "128Mi"
+`,
+			},
+			resourcesProfiles: profiles,
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/limits-memory: 1 GB
+    telegraf.influxdata.com/requests-cpu: 1 core
+    telegraf.influxdata.com/resources-profile: large
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 512Mi
+      requests:
+        cpu: 100m
+        memory: 256Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+
+
+
+    [agent]
+      flush_interval = "30s"
+      metric_buffer_limit = 100000
+type: Opaque`},
+		},
+		{
+			name: "invalid resources of the pod fall back to the class",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:        "profiles",
+						TelegrafRequestsCPU:  "1 core",
+						TelegrafLimitsMemory: "1 GB",
+					},
+				},
+			},
+			classes: map[string]string{
+				"profiles": `[agent]
+  flush_interval = "30s"
+
+[telegraf_operator.container]
+  requests_cpu = "50m"
+  limits_memory = "128Mi"
+`,
+			},
+			resourcesProfiles: profiles,
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/limits-memory: 1 GB
+    telegraf.influxdata.com/requests-cpu: 1 core
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 128Mi
+      requests:
+        cpu: 50m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: profiles
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [agent]
+      flush_interval = "30s"
+
+
+type: Opaque`},
+		},
+		{
+			name: "unknown resources profile",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafResourcesProfile: "medium",
+					},
+				},
+			},
+			resourcesProfiles: profiles,
+			wantErr:           `unknown resources profile "medium" in telegraf.influxdata.com/resources-profile annotation, expected one of: large, small`,
+		},
+		{
+			name: "resolved image digest",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPort: "6060",
+					},
+				},
+			},
+			imageResolver: &imageResolver{
+				Digests: map[string]string{defaultTelegrafImage: "sha256:0123456789abcdef"},
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/port: "6060"
+    telegraf.influxdata.com/resolved-image-telegraf: docker.io/library/telegraf:1.22@sha256:0123456789abcdef
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22@sha256:0123456789abcdef
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: default
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2+
+
+    [[inputs.prometheus]]
+      urls = ["http://127.0.0.1:6060/metrics"]
+
+
+type: Opaque`},
+		},
+		{
+			name: "secret references of the class",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:       "secretrefs",
+						TelegrafMetricsPort: "6060",
+					},
+				},
+			},
+			classes: map[string]string{
+				"secretrefs": `[[outputs.influxdb_v2]]
+  token = "${secretRef:influxdb-auth/token}"
+`,
+			},
+			wantPod: `
+metadata:
+  annotations:
+    telegraf.influxdata.com/class: secretrefs
+    telegraf.influxdata.com/port: "6060"
+  creationTimestamp: null
+spec:
+  containers:
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    - name: SECRET_INFLUXDB_AUTH_TOKEN
+      valueFrom:
+        secretKeyRef:
+          key: token
+          name: influxdb-auth
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: secretrefs
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+    [[inputs.prometheus]]
+      urls = ["http://127.0.0.1:6060/metrics"]
+
+
+    [[outputs.influxdb_v2]]
+      token = "${SECRET_INFLUXDB_AUTH_TOKEN}"
+type: Opaque`},
+		},
+		{
+			name: "prometheus client of the class",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:              "prometheus-client",
+						PrometheusScrapeAnnotation: "true",
+						PrometheusPortAnnotation:   "8080",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app"}},
+				},
+			},
+			classes: map[string]string{
+				"prometheus-client": `[telegraf_operator.prometheus_client]
+  port = 9100
+`,
+			},
+			enableScrapeDiscovery:    true,
+			scrapeDiscoveryPortNames: []string{"metrics", "*-prom"},
+			wantPod: `
+metadata:
+  annotations:
+    prometheus.io/path: /metrics
+    prometheus.io/port: "9100"
+    prometheus.io/scheme: http
+    prometheus.io/scrape: "true"
+    telegraf.influxdata.com/class: prometheus-client
+    telegraf.influxdata.com/original-prometheus-annotations: '{"prometheus.io/port":"8080","prometheus.io/scrape":"true"}'
+  creationTimestamp: null
+spec:
+  containers:
+  - name: app
+    resources: {}
+  - command:
+    - telegraf
+    - --config
+    - /etc/telegraf/telegraf.conf
+    env:
+    - name: NODENAME
+      valueFrom:
+        fieldRef:
+          fieldPath: spec.nodeName
+    image: docker.io/library/telegraf:1.22
+    name: telegraf
+    ports:
+    - containerPort: 9100
+      name: telegraf-prom
+      protocol: TCP
+    resources:
+      limits:
+        cpu: 200m
+        memory: 200Mi
+      requests:
+        cpu: 10m
+        memory: 10Mi
+    volumeMounts:
+    - mountPath: /etc/telegraf
+      name: telegraf-config
+  volumes:
+  - name: telegraf-config
+    secret:
+      secretName: telegraf-config-myname
+status: {}
+`,
+			wantSecrets: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  annotations:
+    app.kubernetes.io/managed-by: telegraf-operator
+  creationTimestamp: null
+  labels:
+    telegraf.influxdata.com/class: prometheus-client
+    telegraf.influxdata.com/pod: myname
+  name: telegraf-config-myname
+  namespace: mynamespace
+stringData:
+  telegraf.conf: |2
+
+    [[inputs.prometheus]]
+      urls = ["http://127.0.0.1:8080/metrics"]
+
+
+
+    [[outputs.prometheus_client]]
+      listen = ":9100"
+      path = "/metrics"
+type: Opaque`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classes := map[string]string{
+				"default": "",
+				"istio":   "# istio outputs",
+			}
+			for name, data := range tt.classes {
+				classes[name] = data
+			}
+			dir := createTempClassesDirectory(t, classes)
+			defer os.RemoveAll(dir)
+
+			logger := testr.New(t)
+
+			testClassDataHandler := &directoryClassDataHandler{
+				Logger:                   logger,
+				TelegrafClassesDirectory: dir,
+			}
+
+			handler := &sidecarHandler{
+				ClassDataHandler:            testClassDataHandler,
+				TelegrafDefaultClass:        "default",
+				TelegrafImage:               defaultTelegrafImage,
+				TelegrafWatchConfig:         tt.telegrafWatchConfig,
+				EnableDefaultInternalPlugin: tt.enableDefaultInternalPlugin,
+				EnableIstioInjection:        tt.enableIstioInjection,
+				IstioOutputClass:            tt.istioOutputClass,
+				IstioTelegrafImage:          tt.istioTelegrafImage,
+				RequestsCPU:                 defaultRequestsCPU,
+				RequestsMemory:              defaultRequestsMemory,
+				LimitsCPU:                   defaultLimitsCPU,
+				LimitsMemory:                defaultLimitsMemory,
+				IstioRequestsCPU:            defaultRequestsCPU,
+				IstioRequestsMemory:         defaultRequestsMemory,
+				IstioLimitsCPU:              defaultLimitsCPU,
+				IstioLimitsMemory:           defaultLimitsMemory,
+				ResourcesProfiles:           tt.resourcesProfiles,
+				ImageResolver:               tt.imageResolver,
+				EnableScrapeDiscovery:       tt.enableScrapeDiscovery,
+				ScrapeDiscoveryPortNames:    tt.scrapeDiscoveryPortNames,
+				Logger:                      testr.New(t),
+			}
+			if tt.clientCertificate {
+				handler.ClientCertIssuer = newTestClientCertIssuer(t, time.Hour)
+			}
+
+			result, err := handler.addSidecars(tt.pod, "myname", "mynamespace")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error %v, want %v", err, tt.wantErr)
+				}
+				if _, ok := err.(*nonFatalError); ok {
+					t.Errorf("unexpected non-fatal error %v, the pod must be rejected", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error adding to sidecar: %v", err)
+			}
+
+			if want, got := len(tt.wantSecrets), len(result.secrets); got != want {
+				t.Errorf("invalid number of secrets returned got: %d; want: %d", got, want)
+			}
+			for i := 0; i < len(result.secrets); i++ {
+				if want, got := strings.TrimSpace(tt.wantSecrets[i]), strings.TrimSpace(toYAML(t, summarizeTestCertificates(t, result.secrets[i]))); got != want {
+					t.Errorf("unexpected secret %d got:\n%v\nwant:\n%v", i, got, want)
+				}
+			}
+
+			if tt.wantPod != "" {
+				if want, got := strings.TrimSpace(tt.wantPod), strings.TrimSpace(toYAML(t, tt.pod)); got != want {
+					t.Errorf("unexpected pod got:\n%v\nwant:\n%v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_withNamespaceDefaults(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "mynamespace",
+			Annotations: map[string]string{
+				TelegrafClass:          "team",
+				TelegrafRequestsMemory: "50Mi",
+				TelegrafEnableInternal: "true",
+				"unrelated":            "value",
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		pod       *corev1.Pod
+		want      map[string]string
+	}{
+		{
+			name:      "namespace annotations are used as defaults",
+			namespace: "mynamespace",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPort: "6060",
+					},
+				},
+			},
+			want: map[string]string{
+				TelegrafMetricsPort:    "6060",
+				TelegrafClass:          "team",
+				TelegrafRequestsMemory: "50Mi",
+				TelegrafEnableInternal: "true",
+			},
+		},
+		{
+			name:      "pod annotations take precedence",
+			namespace: "mynamespace",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass:          "app",
+						TelegrafEnableInternal: "false",
+					},
+				},
+			},
+			want: map[string]string{
+				TelegrafClass:          "app",
+				TelegrafRequestsMemory: "50Mi",
+				TelegrafEnableInternal: "false",
+			},
+		},
+		{
+			name:      "unknown namespace does not add defaults",
+			namespace: "other",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafClass: "app",
+					},
+				},
+			},
+			want: map[string]string{
+				TelegrafClass: "app",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				Client: testclient.NewFakeClientWithScheme(scheme, namespace),
+				Logger: testr.New(t),
+			}
+
+			original := tt.pod.DeepCopy()
+			got, err := handler.withNamespaceDefaults(tt.pod, tt.namespace)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Annotations, tt.want) {
+				t.Errorf("withNamespaceDefaults() = %v, want %v", got.Annotations, tt.want)
+			}
+			if !reflect.DeepEqual(tt.pod, original) {
+				t.Errorf("withNamespaceDefaults() modified the original pod: %v", tt.pod.Annotations)
+			}
+		})
+	}
+}
+
+func Test_ports(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want []string
+	}{
+		{
+			name: "ports merges ports for both annotations",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPort:  "6060",
+						TelegrafMetricsPorts: "6060,8080,8888",
+					},
+				},
+			},
+			want: []string{"6060", "8080", "8888"},
+		},
+		{
+			name: "no annotation returns no ports",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{},
+				},
+			},
+		},
+		{
+			name: "ports are unique and returned in order",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPorts: "8086,6060,6060",
+					},
+				},
+			},
+			want: []string{"6060", "8086"},
+		},
+		{
+			name: "single port from TelegrafMetricsPorts",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TelegrafMetricsPorts: "6060",
+					},
+				},
+			},
+			want: []string{"6060"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ports(tt.pod); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ports() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_scrapeHost(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultHost string
+		annotation  string
+		want        string
+		wantPodIP   bool
+		wantErr     bool
+	}{
+		{
+			name: "empty default uses loopback",
+			want: "127.0.0.1",
+		},
+		{
+			name:        "operator default",
+			defaultHost: "localhost",
+			want:        "localhost",
+		},
+		{
+			name:        "IPv6 address is bracketed",
+			defaultHost: "::1",
+			want:        "[::1]",
+		},
+		{
+			name:        "bracketed IPv6 address is kept",
+			defaultHost: "127.0.0.1",
+			annotation:  "[::1]",
+			want:        "[::1]",
+		},
+		{
+			name:        "pod IP",
+			defaultHost: "127.0.0.1",
+			annotation:  ScrapeHostPodIP,
+			want:        "${POD_IP}",
+			wantPodIP:   true,
+		},
+		{
+			name:        "pod IPv6",
+			defaultHost: ScrapeHostPodIPv6,
+			want:        "[${POD_IP}]",
+			wantPodIP:   true,
+		},
+		{
+			name:        "hostname",
+			defaultHost: "127.0.0.1",
+			annotation:  "metrics.example.com",
+			want:        "metrics.example.com",
+		},
+		{
+			name:        "invalid hostname",
+			defaultHost: "127.0.0.1",
+			annotation:  "host\"]\n[[outputs.exec]]",
+			wantErr:     true,
+		},
+		{
+			name:        "bracketed hostname",
+			defaultHost: "127.0.0.1",
+			annotation:  "[localhost]",
+			wantErr:     true,
+		},
+		{
+			name:        "invalid operator default",
+			defaultHost: "host/path",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &sidecarHandler{
+				ScrapeHost: tt.defaultHost,
+				Logger:     testr.New(t),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{},
+				},
+			}
+			if tt.annotation != "" {
+				pod.Annotations[TelegrafScrapeHost] = tt.annotation
+			}
+
+			got, err := handler.scrapeHost(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, but none was reported")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("scrapeHost() = %v, want %v", got, tt.want)
+			}
+
+			container, err := handler.newContainer(pod, "telegraf", &sidecarConf{})
+			if err != nil {
+				t.Fatalf("unexpected error creating container: %v", err)
+			}
+			gotPodIP := false
+			for _, env := range container.Env {
+				if env.Name == "POD_IP" && env.ValueFrom.FieldRef.FieldPath == "status.podIP" {
+					gotPodIP = true
+				}
+			}
+			if gotPodIP != tt.wantPodIP {
+				t.Errorf("POD_IP environment variable present = %v, want %v", gotPodIP, tt.wantPodIP)
+			}
+		})
+	}
+}
+
+func Test_resolvePorts(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Ports: []corev1.ContainerPort{
+						{Name: "http", ContainerPort: 8080},
+						{Name: "http-metrics", ContainerPort: 9090},
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		ports   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "numeric ports are kept",
+			ports: []string{"6060", " 8080"},
+			want:  []string{"6060", "8080"},
+		},
+		{
+			name:  "named ports are resolved and merged with numeric ports",
+			ports: []string{"http-metrics", "9090", "http"},
+			want:  []string{"8080", "9090"},
+		},
+		{
+			name:    "unknown named port",
+			ports:   []string{"grpc"},
+			wantErr: true,
+		},
+		{
+			name:    "port out of range",
+			ports:   []string{"65536"},
+			wantErr: true,
+		},
+		{
+			name:    "zero port",
+			ports:   []string{"0"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolvePorts(pod, tt.ports)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolvePorts() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolvePorts() = %v, want %v", got, tt.want)
 			}
 		})
 	}
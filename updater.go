@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
@@ -17,11 +19,13 @@ type secretsUpdater struct {
 	logger       logr.Logger
 	clientset    kubernetes.Interface
 	batchDelay   time.Duration
-	assembleConf func(*corev1.Pod, string) (string, error)
+	assembleConf func(*corev1.Pod, string) (*sidecarConf, error)
+	// policy is checked for re-rendered configurations, as inputs may come from ConfigMaps that have changed
+	policy *policyConfig
 }
 
 // newSecretsUpdater creates new instance of secretsUpdater.
-func newSecretsUpdater(logger logr.Logger, sidecar *sidecarHandler) (*secretsUpdater, error) {
+func newSecretsUpdater(logger logr.Logger, sidecar *sidecarHandler, policy *policyConfig) (*secretsUpdater, error) {
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return nil, err
@@ -36,7 +40,8 @@ func newSecretsUpdater(logger logr.Logger, sidecar *sidecarHandler) (*secretsUpd
 		logger:       logger,
 		clientset:    clientset,
 		batchDelay:   10 * time.Second,
-		assembleConf: sidecar.assembleConf,
+		assembleConf: sidecar.assembleSidecarConfWithNamespaceDefaults,
+		policy:       policy,
 	}, nil
 }
 
@@ -65,6 +70,11 @@ func (u *secretsUpdater) onChange() {
 
 // updateSecretsInNamespace updates secrets in a single namespace, returning errors if they occur
 func (u *secretsUpdater) updateSecretsInNamespace(ctx context.Context, namespace string) error {
+	return u.updateSecrets(ctx, namespace, func(*corev1.Secret) bool { return true })
+}
+
+// updateSecrets updates secrets in a single namespace that match the filter, returning errors if they occur
+func (u *secretsUpdater) updateSecrets(ctx context.Context, namespace string, filter func(*corev1.Secret) bool) error {
 	secretsClient := u.clientset.CoreV1().Secrets(namespace)
 
 	// find all secrets having the label set by telegraf-operator, limiting results only to secrets
@@ -77,6 +87,10 @@ func (u *secretsUpdater) updateSecretsInNamespace(ctx context.Context, namespace
 	}
 
 	for _, secret := range secrets.Items {
+		if !filter(&secret) {
+			continue
+		}
+
 		// get the pod and class name labels
 		podName := secret.GetLabels()[TelegrafSecretLabelPod]
 		className := secret.GetLabels()[TelegrafSecretLabelClassName]
@@ -92,13 +106,27 @@ func (u *secretsUpdater) updateSecretsInNamespace(ctx context.Context, namespace
 			return err
 		}
 
-		telegrafConf, err := u.assembleConf(pod, className)
-		if err != nil {
+		conf, err := u.assembleConf(pod, className)
+		if apierrors.IsNotFound(err) || errors.Is(err, errConfigMapKeyNotFound) {
+			// a ConfigMap with inputs or its key was deleted; keep the current configuration until it is created again
+			u.logger.Info("not updating secret, referenced object not found", "namespace", namespace, "name", secret.Name, "podName", podName, "error", err.Error())
+			continue
+		} else if err != nil {
 			return err
 		}
 
+		// configuration that violates the policy is never written, the sidecar keeps its current configuration
+		if u.policy != nil {
+			if err := u.policy.checkConf(namespace, conf); err != nil {
+				u.logger.Error(err, "not updating secret", "namespace", namespace, "name", secret.Name, "podName", podName, "class", className)
+				continue
+			}
+		}
+
+		telegrafConf := conf.telegrafConf
+
 		// check whether secret should be updated, perform the update if needed
-		if string(secret.Data[TelegrafSecretDataKey]) != telegrafConf {
+		if !sameTelegrafConf(string(secret.Data[TelegrafSecretDataKey]), telegrafConf) {
 			u.logger.Info("updating secret", "namespace", namespace, "name", secret.Name, "podName", podName, "class", className)
 			secret.Data[TelegrafSecretDataKey] = []byte(telegrafConf)
 
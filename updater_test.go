@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
@@ -21,10 +23,10 @@ type mockSidecarHandler struct {
 }
 
 // assembleConf generates a mock result that is not a valid telegraf configuration, but namespace, name and class name separated by dot for testing purposes
-func (h *mockSidecarHandler) assembleConf(pod *corev1.Pod, className string) (string, error) {
+func (h *mockSidecarHandler) assembleConf(pod *corev1.Pod, className string) (*sidecarConf, error) {
 	val := fmt.Sprintf("%s.%s.%s", pod.Namespace, pod.Name, className)
 	h.assembleConfResults = append(h.assembleConfResults, val)
-	return val, nil
+	return &sidecarConf{telegrafConf: val, rawInputs: pod.Annotations[TelegrafRawInput]}, nil
 }
 
 // get method returns sorted list of invocations that assempleConf() method was called for.
@@ -191,3 +193,68 @@ func Test_Secret1Updated(t *testing.T) {
 		t.Errorf("last action mismatch: %v", lastAction)
 	}
 }
+
+func Test_SecretWithClientCertificateSerialNotUpdated(t *testing.T) {
+	test := newSecretsUpdaterTest(t)
+	// the comment added when the client certificate is rotated does not cause the secret to be updated
+	test.secret2.Data[TelegrafSecretDataKey] = []byte(withClientCertificateSerial("ns1.pod2.app", nil))
+
+	test.createObjects()
+	test.updater.onChange()
+
+	// assume 4 actions called on Kubernetes client - list namespaces, list secrets, get 2 pods
+	if want, got := 4, len(test.fakeClient.Actions()); want != got {
+		t.Errorf("wanted %d actions to be invoked, got %d", want, got)
+	}
+}
+
+func Test_SecretNotUpdatedWhenReferencedObjectNotFound(t *testing.T) {
+	test := newSecretsUpdaterTest(t)
+	test.secret1.Data[TelegrafSecretDataKey] = []byte("current")
+	test.createObjects()
+	test.updater.assembleConf = func(pod *corev1.Pod, className string) (*sidecarConf, error) {
+		return nil, fmt.Errorf("unable to get ConfigMap: %w", apierrors.NewNotFound(corev1.Resource("configmaps"), "inputs"))
+	}
+
+	if err := test.updater.updateSecretsInNamespace(context.Background(), "ns1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	secret, err := test.fakeClient.CoreV1().Secrets("ns1").Get(context.Background(), test.secret1.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := "current", string(secret.Data[TelegrafSecretDataKey]); want != got {
+		t.Errorf("secret updated; want=%q; got=%q", want, got)
+	}
+}
+
+func Test_OtherSecretsUpdatedWhenConfigMapKeyNotFound(t *testing.T) {
+	test := newSecretsUpdaterTest(t)
+	test.secret1.Data[TelegrafSecretDataKey] = []byte("current")
+	test.secret2.Data[TelegrafSecretDataKey] = []byte("outdated")
+	test.createObjects()
+	test.updater.assembleConf = func(pod *corev1.Pod, className string) (*sidecarConf, error) {
+		if pod.Name == "pod1" {
+			return nil, fmt.Errorf("unable to get inputs: %w", errConfigMapKeyNotFound)
+		}
+		return test.mockSidecar.assembleConf(pod, className)
+	}
+
+	if err := test.updater.updateSecretsInNamespace(context.Background(), "ns1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		test.secret1.Name: "current",
+		test.secret2.Name: "ns1.pod2.app",
+	} {
+		secret, err := test.fakeClient.CoreV1().Secrets("ns1").Get(context.Background(), name, v1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := string(secret.Data[TelegrafSecretDataKey]); want != got {
+			t.Errorf("unexpected data of secret %s; want=%q; got=%q", name, want, got)
+		}
+	}
+}